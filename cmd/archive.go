@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"github.com/wlcmtunknwndth/L0_WB/internal/retention"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage/postgresql"
+	"log/slog"
+)
+
+// archive -- runs the archive subcommand: "run" archives the expired orders once, "restore <order_uid>..." brings the archived
+// orders back to the live tables.
+func archive(cfg *config.Config, log *slog.Logger, args []string) error {
+	const op = "main.archive"
+
+	if len(args) == 0 || (args[0] == "restore" && len(args) == 1) {
+		return fmt.Errorf("%s: usage: archive run|restore <order_uid>...", op)
+	}
+
+	db, err := postgresql.New(cfg.DbConfig, log)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer db.Close()
+
+	// the cache of the running service isn't reachable from here, orders archived by "run" stay there until evicted
+	job, err := retention.New(db, nil, cfg.Retention, log)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "run":
+		if cfg.Retention.Days == 0 {
+			return fmt.Errorf("%s: retention days must be positive", op)
+		}
+		if _, err = job.Archive(ctx); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	case "restore":
+		for _, uuid := range args[1:] {
+			if _, err = job.Restore(ctx, uuid); err != nil {
+				return fmt.Errorf("%s: %w", op, err)
+			}
+			log.Info("restored archived order", "order_uid", uuid)
+		}
+	default:
+		return fmt.Errorf("%s: unknown command %q", op, args[0])
+	}
+	return nil
+}
@@ -1,56 +1,120 @@
 package main
 
 import (
-	"encoding/json"
-	"github.com/brianvoe/gofakeit/v6"
+	"context"
+	"errors"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/nats-io/stan.go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/wlcmtunknwndth/L0_WB/internal/cacher"
 	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"github.com/wlcmtunknwndth/L0_WB/internal/http-server/handlers"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/metrics"
 	natsServer "github.com/wlcmtunknwndth/L0_WB/internal/nats-server"
+	"github.com/wlcmtunknwndth/L0_WB/internal/retention"
 	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
 	"github.com/wlcmtunknwndth/L0_WB/internal/storage/postgresql"
-	"io"
+	"github.com/wlcmtunknwndth/L0_WB/internal/tracing"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 type Database interface {
-	SaveOrder(order *storage.Order) error
-	GetOrder(uuid string) (*storage.Order, error)
+	SaveOrder(ctx context.Context, order *storage.Order) error
+	GetOrder(ctx context.Context, uuid string) (*storage.Order, error)
+	Delete(ctx context.Context, uuid string) error
 	Close() error
 }
 
 func main() {
 	cfg := config.MustLoad()
 
-	db, err := postgresql.New(cfg.DbConfig)
+	log := logger.New(cfg.Log)
+	slog.SetDefault(log)
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(cfg.DbConfig, log, os.Args[2:]); err != nil {
+			slog.Error("couldn't migrate", logger.Err(err))
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "archive" {
+		if err := archive(cfg, log, os.Args[2:]); err != nil {
+			slog.Error("couldn't archive", logger.Err(err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	flushTraces, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		slog.Error("couldn't setup tracing", logger.Err(err))
+		return
+	}
+
+	db, err := postgresql.New(cfg.DbConfig, log)
 	if err != nil {
-		slog.Error("couldn't open db:", err)
+		slog.Error("couldn't open db", logger.Err(err))
+		return
 	}
-	defer func(db Database) {
-		err := db.Close()
+	if cfg.DbConfig.Migrate {
+		version, err := db.Migrate(context.Background())
 		if err != nil {
-			slog.Error("wasn't able to close db connection: ", err)
+			slog.Error("couldn't migrate db", logger.Err(err))
+			return
 		}
-	}(db)
+		slog.Info("db schema is up to date", "version", version)
+	}
 
-	sc := natsServer.New(cfg, db)
+	cach, err := cacher.New(db, cfg.Cache, log)
+	if err != nil {
+		slog.Error("couldn't create cacher", logger.Err(err))
+		return
+	}
 
-	cach := cacher.New(db, 1*time.Minute, 3*time.Minute)
+	sc, err := natsServer.New(cfg, db, cach, log)
+	if err != nil {
+		slog.Error("couldn't connect to nats streaming", logger.Err(err))
+		return
+	}
 
-	// Restoring cache
-	err = cach.Restore()
-	if err = cach.Restore(); err != nil {
-		slog.Error("couldn't restore cache: ", err)
-	} else {
-		slog.Info("cache successfully restored")
+	archiver, err := retention.New(db, cach, cfg.Retention, log)
+	if err != nil {
+		slog.Error("couldn't create retention job", logger.Err(err))
+		return
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Restoring cache in background, the service isn't ready until it's done. Saver and Deleter are run after that, so the orders
+	// saved or deleted meanwhile aren't overwritten by the restored ones
+	go func() {
+		if err := cach.Restore(); err != nil {
+			slog.Error("couldn't restore cache", logger.Err(err))
+		} else {
+			slog.Info("cache successfully restored")
+		}
+
+		if _, err := sc.Saver(); err != nil {
+			slog.Error("couldn't run saver", logger.Err(err))
+			stop()
+			return
+		}
+		if _, err := sc.Deleter(); err != nil {
+			slog.Error("couldn't run deleter", logger.Err(err))
+			stop()
+		}
+	}()
+
 	// Goroutine for cacher.SaveCache which backups cache every chosen time
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := time.NewTicker(cfg.Cache.BackupInterval)
 	quit := make(chan struct{})
 	go func() {
 		for {
@@ -66,201 +130,121 @@ func main() {
 			}
 		}
 	}()
-	defer close(quit)
-
-	//defer func(cach *cacher.Cacher) {
-	//	err := cach.SaveCache()
-	//	if err != nil {
-	//		slog.Error("couldn't backup cache: ", err)
-	//	}
-	//}(cach)
 
-	// Run Saver() subscription
-	saverSub, err := sc.Saver()
-	defer func(sub stan.Subscription) {
-		if err := sub.Close(); err != nil {
-			slog.Error("couldn't close saver: ", err)
+	// Orders missing in cache are read either from db directly or requested over NATS from GetHandler()
+	fetchOrder := db.GetOrder
+	if cfg.Server.ReadMode == config.ReadModeNats {
+		if _, err = sc.GetHandler(); err != nil {
+			slog.Error("couldn't start get handler", logger.Err(err))
 			return
 		}
-	}(saverSub)
-	if err != nil {
-		slog.Error("couldn't run saver: ", err)
-		return
+		fetchOrder = sc.RequestOrder
 	}
 
-	// Run GetHandler() subscription
-	getterSub, err := sc.GetHandler()
-	if err != nil {
-		slog.Error("couldn't start get handler: ", err)
+	// Run DeadLetterIndex() subscription
+	if _, err = sc.DeadLetterIndex(); err != nil {
+		slog.Error("couldn't start dead-letter index", logger.Err(err))
 		return
 	}
-	defer func(sub stan.Subscription) {
-		if err := sub.Close(); err != nil {
-			slog.Error("couldn't close connection: ", err)
-			return
-		}
-	}(getterSub)
 
 	router := chi.NewRouter()
 	router.Use(middleware.RequestID) // adds requestID to logs
+	router.Use(tracing.Middleware)
+	router.Use(metrics.Middleware) // goes before Recoverer, so panics are counted as 500
 	router.Use(middleware.Recoverer)
 	router.Use(middleware.URLFormat) // adds request format
-	router.Use(middleware.Logger)
+	router.Use(logger.Middleware(log))
 
-	// Gets the post request with storage.Order in body
-	router.Post("/save", func(w http.ResponseWriter, r *http.Request) {
-		defer func(Body io.ReadCloser) {
-			err := Body.Close()
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}(r.Body)
-
-		// getting body
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			slog.Error("error decoding request: ", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		//caching new order
-		var order storage.Order
-		if err = json.Unmarshal(body, &order); err != nil {
-			slog.Error("couldn't unmarshall order: ", err)
-		}
-		cach.CacheOrder(order)
-
-		// publishing order to streaming channel with SaveOrder message(command)
-		if err = sc.PublishOrder(body); err != nil {
-			slog.Error("couldn't publish order: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		// Writing response
-		if _, err = w.Write([]byte("saved")); err != nil {
-			slog.Error("couldn't write body: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	health := handlers.NewHealth(cfg.Server.LookupTimeout, map[string]handlers.Check{
+		"db":    db.Ping,
+		"nats":  sc.Ping,
+		"cache": cach.Ready,
 	})
+	router.Get("/healthz", health.Live)
+	router.Get("/readyz", health.Ready)
+	router.Handle("/metrics", promhttp.Handler())
 
-	//Gets the body of save_random post request(must be empty) and creates a random order, which it saves in the storage and writes back to usr order's uuid
-	router.Post("/save_random", func(w http.ResponseWriter, r *http.Request) {
-		uuid := gofakeit.UUID()
+	orders := handlers.NewOrders(cach, db, sc, fetchOrder, cfg.Server.LookupTimeout, cfg.Server.BatchTimeout, log)
+	router.Mount("/orders", orders.Routes())
+	router.Mount("/dlq", handlers.NewDeadLetters(sc, log).Routes())
 
-		order := storage.RandomOrder(uuid)
-		orderBytes, err := json.Marshal(order)
-		if err != nil {
-			slog.Error("couldn't encode random order: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	// Deprecated routes, kept for old clients
+	router.With(handlers.Deprecated("/orders")).Post("/save", orders.Create)
+	router.With(handlers.Deprecated("/orders")).Post("/save_random", orders.CreateRandom)
+	router.With(handlers.Deprecated("/orders/{order_uid}")).Get("/get", orders.GetByBody)
 
-		//cache
-		cach.CacheOrder(*order)
-
-		// publishing order to Saver handler with SaveOrder message
-		if err = sc.PublishOrder(orderBytes); err != nil {
-			slog.Error("couldn't publish order: ", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		// writes uuid of a randomly created order
-		if _, err = w.Write([]byte(uuid)); err != nil {
-			slog.Error("Couldn't write head")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-	})
+	srv := &http.Server{
+		Addr:         cfg.Server.Address,
+		Handler:      router,
+		ReadTimeout:  cfg.Server.Timeout,
+		WriteTimeout: cfg.Server.Timeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+	}
 
-	router.Get("/get", func(w http.ResponseWriter, r *http.Request) {
-		req, err := io.ReadAll(r.Body)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			slog.Error("couldn't get body: ", err)
-			return
-		}
-		defer func(Body io.ReadCloser) {
-			err := Body.Close()
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}(r.Body)
+	// Archiving expired orders in background until shutdown, the batch being archived is rolled back
+	archived := make(chan struct{})
+	go func() {
+		defer close(archived)
+		archiver.Run(ctx)
+	}()
 
-		// unmarshalling uuid in request body
-		var searchReq storage.SearchRequest
-		if err = json.Unmarshal(req, &searchReq); err != nil {
-			slog.Error("couldn't unmarshall search request: ", err)
-			return
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to start server", logger.Err(err))
+			stop()
 		}
+	}()
+	slog.Info("server started", "address", cfg.Server.Address)
 
-		// gets the order from storage by uuid in request
-		if order, found := cach.GetOrder(searchReq.Uuid); found {
-			err = SendOrderAsJson(order, w)
-			if err != nil {
-				slog.Error("couldn't send cached back: ", err)
-			} else {
-				slog.Info("sent cached order")
-			}
-		}
+	<-ctx.Done()
+	shutdown(cfg.Server.ShutdownTimeout, srv, sc, cach, db, quit, archived, flushTraces)
+}
 
-		// create a channel, waiting for OrderGetter subscription to get the data from GetHandler
-		ch := make(chan bool)
+// shutdown -- stops accepting requests and waits for the in-flight ones, drains broker subscriptions, makes the final cache backup,
+// waits for the retention job to roll back its batch, closes db and flushes traces. Everything must be done within timeout,
+// otherwise the rest is cut off.
+func shutdown(timeout time.Duration, srv *http.Server, sc *natsServer.Broker, cach *cacher.Cacher, db Database, quit chan struct{},
+	archived <-chan struct{}, flushTraces func(context.Context) error) {
+	slog.Info("shutting down", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("couldn't shutdown server", logger.Err(err))
+	}
 
-		// run a subscription waiting for message with uuid from body with the needed order as the data
-		sub, err := sc.OrderGetter(searchReq.Uuid, w, &ch, cach)
-		if err != nil {
-			slog.Error("couldn't run receiver: ", err)
-			return
-		}
-		defer func(sub stan.Subscription) {
-			if err := sub.Close(); err != nil {
-				slog.Error("couldn't close connection: ", err)
-				return
-			}
-		}(sub)
+	if err := sc.Shutdown(ctx); err != nil {
+		slog.Error("couldn't shutdown broker", logger.Err(err))
+	}
 
-		// publishing uuid from user's body. UUID must be published for GetHandler only after OrderGetter was started.
-		if err = sc.PublishUUID([]byte(searchReq.Uuid)); err != nil {
-			slog.Error("couldn't publish uuid: ", err)
-			w.WriteHeader(http.StatusBadRequest)
+	close(quit)
+	backup := make(chan struct{})
+	go func() {
+		defer close(backup)
+		if err := cach.SaveCache(); err != nil {
+			slog.Error("couldn't backup cache", logger.Err(err))
 			return
 		}
-
-		// channel waits for OrderGetter to get and write message
-		<-ch
-	})
-
-	srv := &http.Server{
-		Addr:         cfg.Server.Address,
-		Handler:      router,
-		ReadTimeout:  cfg.Server.Timeout,
-		WriteTimeout: cfg.Server.Timeout,
-		IdleTimeout:  cfg.Server.IdleTimeout,
+		slog.Info("made a cache backup")
+	}()
+	select {
+	case <-backup:
+	case <-ctx.Done():
+		slog.Error("cache backup timed out")
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
-		slog.Error("failed to start server")
+	select {
+	case <-archived:
+	case <-ctx.Done():
+		slog.Error("retention job didn't stop in time")
 	}
-	//slog.Error("application finished")
-}
 
-// SendOrderAsJson  -- sends storage.Order instance to the http.ResponseWriter response body.
-func SendOrderAsJson(order *storage.Order, w http.ResponseWriter) error {
-	answer, err := json.Marshal(*order)
-	if err != nil {
-		slog.Error("couldn't marshal order: ", err)
-		return err
+	if err := db.Close(); err != nil {
+		slog.Error("wasn't able to close db connection", logger.Err(err))
 	}
 
-	if _, err = w.Write(answer); err != nil {
-		slog.Error("couldn't send answer: ", err)
-		return err
+	if err := flushTraces(ctx); err != nil {
+		slog.Error("couldn't flush traces", logger.Err(err))
 	}
-	return nil
+	slog.Info("application finished")
 }
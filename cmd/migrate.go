@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage/postgresql"
+	"log/slog"
+	"strconv"
+)
+
+// migrate -- runs the migrate subcommand: "up" applies the pending migrations, "down [n]" reverts n last ones(1 by default),
+// "version" prints the current schema version.
+func migrate(cfg config.DbConfig, log *slog.Logger, args []string) error {
+	const op = "main.migrate"
+
+	if len(args) == 0 {
+		return fmt.Errorf("%s: usage: migrate up|down [n]|version", op)
+	}
+
+	db, err := postgresql.New(cfg, log)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	var version int
+	switch args[0] {
+	case "up":
+		version, err = db.Migrate(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("%s: down takes a positive number of migrations, got %q", op, args[1])
+			}
+		}
+		version, err = db.MigrateDown(ctx, steps)
+	case "version":
+		version, err = db.SchemaVersion(ctx)
+	default:
+		return fmt.Errorf("%s: unknown command %q", op, args[0])
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("db schema version", "version", version)
+	return nil
+}
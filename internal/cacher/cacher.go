@@ -1,53 +1,269 @@
 package cacher
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/patrickmn/go-cache"
+	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/metrics"
 	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// cached -- is the map with saved uuids in current run, so it is easier to back up
-var cached = make(map[string]struct{})
-
 type Storage interface {
 	RestoreCache() (*[]storage.Order, error)
 	SaveCache(uuid string) error
 	DeleteCache(uuid string) error
 	IsAlreadyCached(uuid string) bool
+	ListOrders(ctx context.Context, filter storage.OrderFilter) ([]storage.Order, string, error)
+	OrderVersions(ctx context.Context, uuids []string) (map[string]int64, error)
 }
 
 type Cacher struct {
-	handler *cache.Cache
-	db      Storage
+	handler  *cache.Cache
+	db       Storage
+	log      *slog.Logger
+	restored atomic.Bool
+
+	// cached -- is the set of uuids cached in current run, so it is easier to back up. Guarded by mu, as it's changed by HTTP
+	// handlers, NATS callbacks and the janitor evicting expired orders. So are policy and the approximate sizes of cached orders.
+	mu         sync.Mutex
+	cached     map[string]struct{}
+	policy     Policy
+	sizes      map[string]int64
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+	// dropping -- are the victims being deleted from handler by cacheOrder with mu held, their onEvicted must not take mu.
+	// deleting -- are the orders being deleted by Delete, their onEvicted doesn't count an eviction. Both are guarded by dropMu.
+	dropMu   sync.Mutex
+	dropping map[string]struct{}
+	deleting map[string]struct{}
+	// backupMu -- serializes the backup writes with the deletes, so a backup is deleted only if the order isn't cached again.
+	backupMu sync.Mutex
+
+	// snapshots -- is nil unless cache is backed up by snapshots.
+	snapshots SnapshotStore
+	warmUp    config.Cache
+	// writeThrough -- orders are cached by OrderSaved only, otherwise by OrderPublished and rolled back by OrderFailed.
+	writeThrough bool
 }
 
-// New -- creates new instance of Cacher with Storage interface and cache.Cache vars. expTime -- is the standard expiration time of cached item.
-// purgeTime -- is the time the cacher cleans up itself
-func New(db Storage, expTime time.Duration, purgeTime time.Duration) *Cacher {
-	return &Cacher{
-		handler: cache.New(expTime, purgeTime),
-		db:      db,
+// New -- creates new instance of Cacher with Storage interface and cache.Cache vars. Orders expire after cfg.TTL with
+// config.CachePolicyTTLLRU only, the other policies keep orders until they are evicted by cfg.MaxEntries or cfg.MaxBytes bound.
+func New(db Storage, cfg config.Cache, log *slog.Logger) (*Cacher, error) {
+	const op = "cacher.New"
+
+	policy, err := NewPolicy(cfg.Policy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	expTime, purgeTime := cfg.TTL, cfg.PurgeInterval
+	if cfg.Policy != config.CachePolicyTTLLRU {
+		expTime, purgeTime = cache.NoExpiration, 0
+	}
+
+	c := &Cacher{
+		handler:    cache.New(expTime, purgeTime),
+		db:         db,
+		log:        log.With("component", "cacher", "policy", cfg.Policy),
+		cached:     make(map[string]struct{}),
+		policy:     policy,
+		sizes:      make(map[string]int64),
+		dropping:   make(map[string]struct{}),
+		deleting:   make(map[string]struct{}),
+		maxEntries: cfg.MaxEntries,
+		maxBytes:   cfg.MaxBytes,
+		warmUp:     cfg,
+	}
+
+	switch cfg.Consistency {
+	case "", config.CacheConsistencyOptimistic:
+	case config.CacheConsistencyWriteThrough:
+		c.writeThrough = true
+	default:
+		return nil, fmt.Errorf("%s: %w: %q", op, ErrUnknownConsistency, cfg.Consistency)
+	}
+
+	switch cfg.WarmUp {
+	case "", config.CacheWarmUpNone, config.CacheWarmUpBackup, config.CacheWarmUpLatest, config.CacheWarmUpWindow:
+	default:
+		return nil, fmt.Errorf("%s: %w: %q", op, ErrUnknownWarmUp, cfg.WarmUp)
+	}
+	switch cfg.Snapshot {
+	case "", config.CacheSnapshotNone:
+	case config.CacheSnapshotFile:
+		c.snapshots = &fileSnapshots{path: cfg.SnapshotFile}
+	case config.CacheSnapshotDB:
+		snapshots, ok := db.(SnapshotStore)
+		if !ok {
+			return nil, fmt.Errorf("%s: %w: storage doesn't keep snapshots", op, ErrUnknownSnapshot)
+		}
+		c.snapshots = snapshots
+	default:
+		return nil, fmt.Errorf("%s: %w: %q", op, ErrUnknownSnapshot, cfg.Snapshot)
 	}
+
+	c.handler.OnEvicted(c.onEvicted)
+	return c, nil
 }
 
-// CacheOrder -- caches the order given as an arg and maps order's uuid to cache map.
+// CacheOrder -- caches the order given as an arg and maps order's uuid to cache map. Orders exceeding the cache bounds are evicted
+// along with their backup.
 func (c *Cacher) CacheOrder(order storage.Order) {
-	c.handler.OnEvicted(c.onEvicted)
-	c.handler.Set(order.OrderID, order, cache.DefaultExpiration)
-	//err := c.db.SaveCache(order.OrderID)
-	//if err != nil {
-	//	slog.Error("couldn't save backup: ", order.OrderID, err)
-	//}
-	cached[order.OrderID] = struct{}{}
+	c.cacheOrder(order, cache.DefaultExpiration)
+}
+
+// cacheOrder -- caches the order for ttl, cache.DefaultExpiration uses the configured one.
+func (c *Cacher) cacheOrder(order storage.Order, ttl time.Duration) {
+	c.mu.Lock()
+	c.handler.Set(order.OrderID, order, ttl)
+	c.cached[order.OrderID] = struct{}{}
+
+	size := sizeOf(&order)
+	c.bytes += size - c.sizes[order.OrderID]
+	c.sizes[order.OrderID] = size
+
+	// victims are picked before the order joins the policy, otherwise LFU would evict the new order first
+	victims := c.victims()
+	c.policy.Add(order.OrderID)
+	// victims are deleted with mu held, otherwise an order cached again meanwhile would be deleted instead of the stale one
+	for _, uuid := range victims {
+		c.drop(uuid)
+	}
+	c.updateGauges()
+	c.mu.Unlock()
+
+	for _, uuid := range victims {
+		c.deleteBackup(uuid)
+	}
+}
+
+// drop -- deletes the victim from handler and the backup set. onEvicted, which is called by handler synchronously, skips the
+// victims, as it takes mu itself. Must be called with mu held.
+func (c *Cacher) drop(uuid string) {
+	metrics.CacheEvictions.Inc()
+
+	c.dropMu.Lock()
+	c.dropping[uuid] = struct{}{}
+	c.dropMu.Unlock()
+
+	c.handler.Delete(uuid)
+	delete(c.cached, uuid)
+
+	c.dropMu.Lock()
+	delete(c.dropping, uuid)
+	c.dropMu.Unlock()
+}
+
+// victims -- picks orders to be evicted until the cache fits its bounds and forgets them. Must be called with mu held.
+func (c *Cacher) victims() []string {
+	var victims []string
+	for c.overflown() {
+		uuid, ok := c.policy.Victim()
+		if !ok {
+			break
+		}
+		c.forget(uuid)
+		victims = append(victims, uuid)
+	}
+	return victims
+}
+
+// overflown -- reports whether the cache exceeds max entries or max bytes. Must be called with mu held.
+func (c *Cacher) overflown() bool {
+	return (c.maxEntries > 0 && len(c.sizes) > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+// forget -- removes the order from eviction policy and size accounting. Must be called with mu held.
+func (c *Cacher) forget(uuid string) {
+	c.policy.Remove(uuid)
+	c.bytes -= c.sizes[uuid]
+	delete(c.sizes, uuid)
+}
+
+// updateGauges -- updates the cache size and pending backup metrics. Must be called with mu held.
+func (c *Cacher) updateGauges() {
+	metrics.CacheSize.Set(float64(c.handler.ItemCount()))
+	metrics.CacheBytes.Set(float64(c.bytes))
+	metrics.CachePendingBackup.Set(float64(len(c.cached)))
 }
 
 // onEvicted -- is a custom func, handling cached item after expiration. It deletes item from cache map and deletes uuid from storage Cache backup.
+// Only expired orders are counted as evicted, the victims are counted by drop and the deleted orders aren't evicted.
 func (c *Cacher) onEvicted(uuid string, data interface{}) {
-	delete(cached, uuid)
-	err := c.db.DeleteCache(uuid)
-	if err != nil {
-		slog.Error("couldn't delete order from cache")
+	c.dropMu.Lock()
+	_, dropping := c.dropping[uuid]
+	_, deleting := c.deleting[uuid]
+	c.dropMu.Unlock()
+	if dropping {
+		return
+	}
+
+	c.mu.Lock()
+	// the order could have been cached again after it had expired
+	if _, found := c.handler.Get(uuid); found {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.cached, uuid)
+	c.forget(uuid)
+	c.updateGauges()
+	c.mu.Unlock()
+
+	if !deleting {
+		metrics.CacheEvictions.Inc()
+	}
+	c.deleteBackup(uuid)
+}
+
+// deleteBackup -- deletes the backup of the evicted order unless it has been cached again since.
+func (c *Cacher) deleteBackup(uuid string) {
+	c.backupMu.Lock()
+	defer c.backupMu.Unlock()
+	if c.isCached(uuid) {
+		return
+	}
+	if err := c.db.DeleteCache(uuid); err != nil {
+		c.log.Error("couldn't delete order from cache backup", "order_uid", uuid, logger.Err(err))
+	}
+}
+
+// isCached -- reports whether the order is in the backup set of the current run.
+func (c *Cacher) isCached(uuid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.cached[uuid]
+	return ok
+}
+
+// ErrUnknownConsistency -- the configured consistency mode isn't supported.
+var ErrUnknownConsistency = errors.New("unknown cache consistency mode")
+
+// OrderPublished -- is called before the order is published to be saved. The order is cached unless the cache is write-through.
+func (c *Cacher) OrderPublished(order storage.Order) {
+	if !c.writeThrough {
+		c.CacheOrder(order)
+	}
+}
+
+// OrderSaved -- is called once the order has been committed to the storage. The order is cached if the cache is write-through.
+func (c *Cacher) OrderSaved(order storage.Order) {
+	if c.writeThrough {
+		c.CacheOrder(order)
+	}
+}
+
+// OrderFailed -- is called if the order couldn't be published or saved. The optimistically cached order is rolled back.
+func (c *Cacher) OrderFailed(uuid string) {
+	if !c.writeThrough {
+		c.Delete(uuid)
 	}
 }
 
@@ -55,18 +271,85 @@ func (c *Cacher) onEvicted(uuid string, data interface{}) {
 func (c *Cacher) GetOrder(uuid string) (*storage.Order, bool) {
 	data, found := c.handler.Get(uuid)
 	if found {
+		metrics.CacheHits.Inc()
+		c.mu.Lock()
+		c.policy.Access(uuid)
+		c.mu.Unlock()
 		order := data.(storage.Order)
 		return &order, true
 	}
+	metrics.CacheMisses.Inc()
 	return nil, false
 }
 
-// Restore -- restores cached item from backup copy in storage. Must be used at the start of ur application.
+// Delete -- removes the order from cache, its backup in storage is removed by onEvicted. Is called once the order has been deleted
+// from storage, which drops the backup of orders missing in cache itself.
+func (c *Cacher) Delete(uuid string) {
+	c.dropMu.Lock()
+	c.deleting[uuid] = struct{}{}
+	c.dropMu.Unlock()
+
+	c.handler.Delete(uuid)
+
+	c.dropMu.Lock()
+	delete(c.deleting, uuid)
+	c.dropMu.Unlock()
+}
+
+// ErrNotRestored -- cache restore hasn't been completed yet.
+var ErrNotRestored = errors.New("cache restore hasn't been completed")
+
+// Restored -- reports whether Restore has been completed, successfully or not.
+func (c *Cacher) Restored() bool {
+	return c.restored.Load()
+}
+
+// Ready -- returns ErrNotRestored until Restore has been completed. Is used as the readiness check.
+func (c *Cacher) Ready(ctx context.Context) error {
+	if !c.Restored() {
+		return ErrNotRestored
+	}
+	return nil
+}
+
+// Restore -- warms the cache up by the configured strategy. Must be used at the start of ur application.
 func (c *Cacher) Restore() error {
+	defer c.restored.Store(true)
+
+	switch c.warmUp.WarmUp {
+	case config.CacheWarmUpNone:
+		return nil
+	case config.CacheWarmUpLatest, config.CacheWarmUpWindow:
+		n, err := c.load(context.Background())
+		if err != nil {
+			c.log.Error("couldn't warm cache up", logger.Err(err))
+			return err
+		}
+		c.log.Info("cache warmed up", "strategy", c.warmUp.WarmUp, "orders", n)
+		return nil
+	}
+	return c.restoreBackup()
+}
+
+// restoreBackup -- restores cached items from backup copy in storage. The snapshot is preferred if configured, the cached table is
+// used if there is no snapshot or it can't be read.
+func (c *Cacher) restoreBackup() error {
+	if c.snapshots != nil {
+		n, err := c.restoreSnapshot()
+		if err == nil {
+			c.log.Info("cache restored from snapshot", "orders", n)
+			return nil
+		}
+		if errors.Is(err, storage.ErrSnapshotNotFound) {
+			c.log.Info("no cache snapshot, restoring from backup table")
+		} else {
+			c.log.Error("couldn't restore cache snapshot, restoring from backup table", logger.Err(err))
+		}
+	}
+
 	orders, err := c.db.RestoreCache()
-	//fmt.Println(orders)
 	if err != nil {
-		slog.Error("couldn't restore cache: ", err)
+		c.log.Error("couldn't restore cache", logger.Err(err))
 		return err
 	}
 
@@ -76,18 +359,109 @@ func (c *Cacher) Restore() error {
 	return nil
 }
 
-// SaveCache -- backups cache to the storage
-func (c *Cacher) SaveCache() error {
-	var err error
-	for key := range cached {
-		if c.db.IsAlreadyCached(key) {
+// restoreSnapshot -- caches the orders of the snapshot with their remaining TTLs. Time spent while the service was down isn't
+// counted. The orders deleted or updated since the snapshot was taken are skipped, they are read from storage on request.
+func (c *Cacher) restoreSnapshot() (int, error) {
+	const op = "cacher.restoreSnapshot"
+
+	data, err := c.snapshots.LoadSnapshot()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	snap, err := decodeSnapshot(data)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	uuids := make([]string, 0, len(snap.Entries))
+	for _, entry := range snap.Entries {
+		uuids = append(uuids, entry.Order.OrderID)
+	}
+	versions, err := c.db.OrderVersions(context.Background(), uuids)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var restored int
+	for _, entry := range snap.Entries {
+		if version, ok := versions[entry.Order.OrderID]; !ok || version != entry.Order.Version {
 			continue
 		}
-		err = c.db.SaveCache(key)
-		if err != nil {
-			slog.Error("couldn't save uuid to cache zone: ", key, err)
-			continue
+		ttl := entry.TTL
+		if ttl <= 0 {
+			ttl = cache.DefaultExpiration
+		}
+		c.cacheOrder(entry.Order, ttl)
+		restored++
+	}
+	if stale := len(snap.Entries) - restored; stale > 0 {
+		c.log.Info("skipped orders changed since the snapshot", "orders", stale)
+	}
+	return restored, nil
+}
+
+// SaveCache -- backups cache to the storage. If snapshots are configured the whole cache is written as one snapshot, otherwise or
+// if writing the snapshot fails, cached uuids are saved to the backup table.
+func (c *Cacher) SaveCache() error {
+	if c.snapshots != nil {
+		err := c.saveSnapshot()
+		if err == nil {
+			return nil
+		}
+		c.log.Error("couldn't save cache snapshot, backing up uuids", logger.Err(err))
+	}
+
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.cached))
+	for key := range c.cached {
+		keys = append(keys, key)
+	}
+	c.mu.Unlock()
+
+	for _, key := range keys {
+		c.saveBackup(key)
+	}
+	return nil
+}
+
+// saveBackup -- saves the uuid to the backup table unless it is there already or the order has been evicted since.
+func (c *Cacher) saveBackup(uuid string) {
+	c.backupMu.Lock()
+	defer c.backupMu.Unlock()
+	if !c.isCached(uuid) || c.db.IsAlreadyCached(uuid) {
+		return
+	}
+	if err := c.db.SaveCache(uuid); err != nil {
+		c.log.Error("couldn't save uuid to cache zone", "order_uid", uuid, logger.Err(err))
+	}
+}
+
+// saveSnapshot -- writes all the unexpired orders with their remaining TTLs as one snapshot.
+func (c *Cacher) saveSnapshot() error {
+	const op = "cacher.saveSnapshot"
+
+	now := time.Now()
+	items := c.handler.Items()
+	snap := snapshot{CreatedAt: now, Entries: make([]snapshotEntry, 0, len(items))}
+	for _, item := range items {
+		entry := snapshotEntry{Order: item.Object.(storage.Order)}
+		if item.Expiration > 0 {
+			entry.TTL = time.Unix(0, item.Expiration).Sub(now)
+			if entry.TTL <= 0 {
+				continue
+			}
 		}
+		snap.Entries = append(snap.Entries, entry)
+	}
+
+	data, err := encodeSnapshot(&snap)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = c.snapshots.SaveSnapshot(data); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
 	}
+	c.log.Debug("saved cache snapshot", "orders", len(snap.Entries), "bytes", len(data))
 	return nil
 }
@@ -0,0 +1,504 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"github.com/wlcmtunknwndth/L0_WB/internal/metrics"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStorage -- in-memory Storage recording the backed up uuids.
+type fakeStorage struct {
+	mu     sync.Mutex
+	backup map[string]struct{}
+	orders []storage.Order
+}
+
+func newFakeStorage(orders ...storage.Order) *fakeStorage {
+	return &fakeStorage{backup: make(map[string]struct{}), orders: orders}
+}
+
+func (f *fakeStorage) RestoreCache() (*[]storage.Order, error) {
+	orders := append([]storage.Order(nil), f.orders...)
+	return &orders, nil
+}
+
+func (f *fakeStorage) SaveCache(uuid string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.backup[uuid] = struct{}{}
+	return nil
+}
+
+func (f *fakeStorage) DeleteCache(uuid string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.backup, uuid)
+	return nil
+}
+
+func (f *fakeStorage) IsAlreadyCached(uuid string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.backup[uuid]
+	return ok
+}
+
+// ListOrders -- lists orders from the newest, the cursor is the offset of the page.
+func (f *fakeStorage) ListOrders(ctx context.Context, filter storage.OrderFilter) ([]storage.Order, string, error) {
+	var orders []storage.Order
+	for _, order := range f.orders {
+		if order.DateCreated.Before(filter.CreatedFrom) {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].DateCreated.After(orders[j].DateCreated) })
+
+	offset, _ := strconv.Atoi(filter.Cursor)
+	orders = orders[min(offset, len(orders)):]
+	if len(orders) <= filter.Limit {
+		return orders, "", nil
+	}
+	return orders[:filter.Limit], strconv.Itoa(offset + filter.Limit), nil
+}
+
+// OrderVersions -- reports the versions of the stored orders.
+func (f *fakeStorage) OrderVersions(ctx context.Context, uuids []string) (map[string]int64, error) {
+	versions := make(map[string]int64)
+	for _, order := range f.orders {
+		if slices.Contains(uuids, order.OrderID) {
+			versions[order.OrderID] = order.Version
+		}
+	}
+	return versions, nil
+}
+
+func (f *fakeStorage) backedUp(uuid string) bool {
+	return f.IsAlreadyCached(uuid)
+}
+
+func newTestCacher(db Storage, expTime, purgeTime time.Duration) *Cacher {
+	return newBoundedCacher(db, config.Cache{Policy: config.CachePolicyTTLLRU, TTL: expTime, PurgeInterval: purgeTime})
+}
+
+func newBoundedCacher(db Storage, cfg config.Cache) *Cacher {
+	c, err := New(db, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func cached(c *Cacher, uuids ...string) []string {
+	var found []string
+	for _, uuid := range uuids {
+		if _, ok := c.GetOrder(uuid); ok {
+			found = append(found, uuid)
+		}
+	}
+	return found
+}
+
+func TestCacherIsolatedInstances(t *testing.T) {
+	first := newTestCacher(newFakeStorage(), time.Minute, time.Minute)
+	second := newTestCacher(newFakeStorage(), time.Minute, time.Minute)
+
+	first.CacheOrder(storage.Order{OrderID: "a"})
+
+	if len(second.cached) != 0 {
+		t.Fatalf("second cacher sees %d orders of the first one", len(second.cached))
+	}
+}
+
+func TestCacherConcurrentAccess(t *testing.T) {
+	db := newFakeStorage()
+	c := newTestCacher(db, 5*time.Millisecond, time.Millisecond)
+
+	const workers, iterations = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				uuid := fmt.Sprintf("order-%d", i%20)
+				switch (w + i) % 4 {
+				case 0:
+					c.CacheOrder(storage.Order{OrderID: uuid})
+				case 1:
+					c.GetOrder(uuid)
+				case 2:
+					if err := c.SaveCache(); err != nil {
+						t.Errorf("SaveCache: %v", err)
+					}
+				case 3:
+					c.Delete(uuid)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestCacherEvictionRemovesBackup(t *testing.T) {
+	db := newFakeStorage()
+	c := newTestCacher(db, 20*time.Millisecond, 5*time.Millisecond)
+
+	c.CacheOrder(storage.Order{OrderID: "a"})
+	if err := c.SaveCache(); err != nil {
+		t.Fatalf("SaveCache: %v", err)
+	}
+	if !db.backedUp("a") {
+		t.Fatal("order wasn't backed up")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for db.backedUp("a") {
+		if time.Now().After(deadline) {
+			t.Fatal("expired order is still in backup")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	c.mu.Lock()
+	_, pending := c.cached["a"]
+	c.mu.Unlock()
+	if pending {
+		t.Fatal("expired order is still pending backup")
+	}
+}
+
+func TestCacherEvictionsMetric(t *testing.T) {
+	c := newBoundedCacher(newFakeStorage(), config.Cache{Policy: config.CachePolicyTTLLRU, TTL: 20 * time.Millisecond,
+		PurgeInterval: 5 * time.Millisecond, MaxEntries: 1})
+	evictions := func() float64 { return testutil.ToFloat64(metrics.CacheEvictions) }
+	before := evictions()
+
+	c.CacheOrder(storage.Order{OrderID: "a"})
+	c.Delete("a")
+	c.CacheOrder(storage.Order{OrderID: "b"})
+	c.OrderFailed("b")
+	if got := evictions() - before; got != 0 {
+		t.Fatalf("deleted orders counted as %v evictions", got)
+	}
+
+	c.CacheOrder(storage.Order{OrderID: "c"})
+	c.CacheOrder(storage.Order{OrderID: "d"})
+	if got := evictions() - before; got != 1 {
+		t.Fatalf("got %v evictions, want 1 for the victim", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for evictions()-before != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v evictions, want 2 once the order has expired", evictions()-before)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCacherRestore(t *testing.T) {
+	c := newTestCacher(newFakeStorage(storage.Order{OrderID: "a"}), time.Minute, time.Minute)
+
+	if err := c.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if !c.Restored() {
+		t.Fatal("cacher isn't marked as restored")
+	}
+	if _, found := c.GetOrder("a"); !found {
+		t.Fatal("restored order isn't cached")
+	}
+}
+
+func TestCacherUnknownPolicy(t *testing.T) {
+	_, err := New(newFakeStorage(), config.Cache{Policy: "fifo"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if !errors.Is(err, ErrUnknownPolicy) {
+		t.Fatalf("got %v, want ErrUnknownPolicy", err)
+	}
+}
+
+func TestCacherLRUEviction(t *testing.T) {
+	db := newFakeStorage()
+	c := newBoundedCacher(db, config.Cache{Policy: config.CachePolicyLRU, MaxEntries: 2})
+
+	c.CacheOrder(storage.Order{OrderID: "a"})
+	c.CacheOrder(storage.Order{OrderID: "b"})
+	if err := c.SaveCache(); err != nil {
+		t.Fatalf("SaveCache: %v", err)
+	}
+	c.GetOrder("a")
+	c.CacheOrder(storage.Order{OrderID: "c"})
+
+	if got := cached(c, "a", "b", "c"); fmt.Sprint(got) != "[a c]" {
+		t.Fatalf("cached %v, want [a c]", got)
+	}
+	if db.backedUp("b") {
+		t.Fatal("evicted order is still in backup")
+	}
+}
+
+func TestCacherLFUEviction(t *testing.T) {
+	c := newBoundedCacher(newFakeStorage(), config.Cache{Policy: config.CachePolicyLFU, MaxEntries: 2})
+
+	c.CacheOrder(storage.Order{OrderID: "a"})
+	c.CacheOrder(storage.Order{OrderID: "b"})
+	c.GetOrder("a")
+	c.GetOrder("b")
+	c.GetOrder("b")
+	c.CacheOrder(storage.Order{OrderID: "c"})
+
+	if got := cached(c, "a", "b", "c"); fmt.Sprint(got) != "[b c]" {
+		t.Fatalf("cached %v, want [b c]", got)
+	}
+}
+
+func TestCacherMaxBytes(t *testing.T) {
+	order := storage.RandomOrder("order-x")
+	limit := 3*sizeOf(order) + sizeOf(order)/2
+	c := newBoundedCacher(newFakeStorage(), config.Cache{Policy: config.CachePolicyLRU, MaxBytes: limit})
+
+	for i := 0; i < 10; i++ {
+		o := *order
+		o.OrderID = fmt.Sprintf("order-%d", i)
+		c.CacheOrder(o)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bytes > limit {
+		t.Fatalf("cache holds %d bytes, limit is %d", c.bytes, limit)
+	}
+	if len(c.sizes) != 3 || len(c.cached) != 3 {
+		t.Fatalf("cache holds %d orders, %d pending backup, want 3", len(c.sizes), len(c.cached))
+	}
+}
+
+func TestCacherConcurrentEviction(t *testing.T) {
+	const workers, iterations = 4, 500
+	for round := 0; round < 20; round++ {
+		db := newFakeStorage()
+		c := newBoundedCacher(db, config.Cache{Policy: config.CachePolicyLRU, MaxEntries: 1})
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < iterations; i++ {
+					// the orders are shared, so a victim of one worker is often cached again by another
+					c.CacheOrder(storage.Order{OrderID: fmt.Sprintf("order-%d", (w+i)%3)})
+					c.mu.Lock()
+					count := c.handler.ItemCount()
+					c.mu.Unlock()
+					if count != 1 {
+						t.Errorf("cache holds %d orders right after caching one, want 1", count)
+						return
+					}
+					if i%50 == 0 {
+						if err := c.SaveCache(); err != nil {
+							t.Errorf("SaveCache: %v", err)
+						}
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		c.mu.Lock()
+		count, sizes, pending := c.handler.ItemCount(), len(c.sizes), len(c.cached)
+		c.mu.Unlock()
+		if count != 1 || sizes != 1 || pending != 1 {
+			t.Fatalf("cache holds %d orders, %d sized, %d pending backup, want 1", count, sizes, pending)
+		}
+
+		if err := c.SaveCache(); err != nil {
+			t.Fatalf("SaveCache: %v", err)
+		}
+		db.mu.Lock()
+		backup := len(db.backup)
+		db.mu.Unlock()
+		if backup != 1 {
+			t.Fatalf("%d orders backed up, want 1", backup)
+		}
+	}
+}
+
+func TestCacherSnapshotRoundTrip(t *testing.T) {
+	cfg := config.Cache{
+		Policy: config.CachePolicyTTLLRU, TTL: time.Hour, PurgeInterval: time.Hour,
+		Snapshot: config.CacheSnapshotFile, SnapshotFile: filepath.Join(t.TempDir(), "cache.snapshot"),
+	}
+	order := storage.RandomOrder("a")
+
+	db := newFakeStorage()
+	c := newBoundedCacher(db, cfg)
+	c.CacheOrder(*order)
+	c.cacheOrder(storage.Order{OrderID: "b"}, time.Minute)
+	if err := c.SaveCache(); err != nil {
+		t.Fatalf("SaveCache: %v", err)
+	}
+	if db.backedUp("a") {
+		t.Fatal("uuid is backed up to the table along with the snapshot")
+	}
+
+	restored := newBoundedCacher(newFakeStorage(storage.Order{OrderID: "from-table"}, *order, storage.Order{OrderID: "b"}), cfg)
+	if err := restored.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	got, found := restored.GetOrder("a")
+	if !found || !got.Equal(order) {
+		t.Fatalf("restored %+v, want %+v", got, order)
+	}
+	_, expiration, _ := restored.handler.GetWithExpiration("b")
+	if ttl := time.Until(expiration); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("restored ttl %v, want remaining ttl up to 1m", ttl)
+	}
+	if _, found = restored.GetOrder("from-table"); found {
+		t.Fatal("backup table is used while snapshot exists")
+	}
+}
+
+func TestCacherSnapshotSkipsChanged(t *testing.T) {
+	cfg := config.Cache{
+		Policy: config.CachePolicyLRU, Snapshot: config.CacheSnapshotFile, SnapshotFile: filepath.Join(t.TempDir(), "cache.snapshot"),
+	}
+
+	c := newBoundedCacher(newFakeStorage(), cfg)
+	for _, uuid := range []string{"kept", "updated", "deleted"} {
+		c.CacheOrder(storage.Order{OrderID: uuid, Version: storage.FirstVersion})
+	}
+	if err := c.SaveCache(); err != nil {
+		t.Fatalf("SaveCache: %v", err)
+	}
+
+	restored := newBoundedCacher(newFakeStorage(
+		storage.Order{OrderID: "kept", Version: storage.FirstVersion},
+		storage.Order{OrderID: "updated", Version: storage.FirstVersion + 1},
+	), cfg)
+	if err := restored.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got := cached(restored, "kept", "updated", "deleted"); fmt.Sprint(got) != "[kept]" {
+		t.Fatalf("restored %v, want [kept]", got)
+	}
+}
+
+func TestCacherSnapshotFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	if err := os.WriteFile(path, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Cache{Policy: config.CachePolicyLRU, Snapshot: config.CacheSnapshotFile, SnapshotFile: path}
+
+	c := newBoundedCacher(newFakeStorage(storage.Order{OrderID: "from-table"}), cfg)
+	if err := c.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if _, found := c.GetOrder("from-table"); !found {
+		t.Fatal("cache isn't restored from backup table")
+	}
+}
+
+func TestDecodeSnapshotVersion(t *testing.T) {
+	data, err := encodeSnapshot(&snapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(snapshotMagic)+1]++
+
+	if _, err = decodeSnapshot(data); !errors.Is(err, ErrSnapshotVersion) {
+		t.Fatalf("got %v, want ErrSnapshotVersion", err)
+	}
+}
+
+func TestCacherWarmUp(t *testing.T) {
+	now := time.Now()
+	var orders []storage.Order
+	for i := 0; i < 10; i++ {
+		orders = append(orders, storage.Order{OrderID: fmt.Sprintf("order-%d", i), DateCreated: now.Add(-time.Duration(i) * time.Hour)})
+	}
+
+	tests := []struct {
+		name string
+		cfg  config.Cache
+		want []string
+	}{
+		{
+			name: "latest",
+			cfg:  config.Cache{WarmUp: config.CacheWarmUpLatest, WarmUpCount: 3, WarmUpBatch: 2},
+			want: []string{"order-0", "order-1", "order-2"},
+		},
+		{
+			name: "latest bounded by max entries",
+			cfg:  config.Cache{WarmUp: config.CacheWarmUpLatest, WarmUpCount: 5, MaxEntries: 2, WarmUpBatch: 4},
+			want: []string{"order-0", "order-1"},
+		},
+		{
+			name: "window",
+			cfg:  config.Cache{WarmUp: config.CacheWarmUpWindow, WarmUpWindow: 150 * time.Minute, WarmUpBatch: 2},
+			want: []string{"order-0", "order-1", "order-2"},
+		},
+		{
+			name: "none",
+			cfg:  config.Cache{WarmUp: config.CacheWarmUpNone},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Policy = config.CachePolicyLRU
+			c := newBoundedCacher(newFakeStorage(orders...), tt.cfg)
+			if err := c.Restore(); err != nil {
+				t.Fatalf("Restore: %v", err)
+			}
+
+			var uuids []string
+			for i := range orders {
+				uuids = append(uuids, orders[i].OrderID)
+			}
+			if got := cached(c, uuids...); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("cached %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacherConsistency(t *testing.T) {
+	order := storage.Order{OrderID: "a"}
+
+	optimistic := newBoundedCacher(newFakeStorage(), config.Cache{Policy: config.CachePolicyLRU})
+	optimistic.OrderPublished(order)
+	if _, found := optimistic.GetOrder("a"); !found {
+		t.Fatal("optimistic cache doesn't cache published order")
+	}
+	optimistic.OrderFailed("a")
+	if _, found := optimistic.GetOrder("a"); found {
+		t.Fatal("optimistic cache doesn't roll failed order back")
+	}
+
+	writeThrough := newBoundedCacher(newFakeStorage(), config.Cache{
+		Policy: config.CachePolicyLRU, Consistency: config.CacheConsistencyWriteThrough,
+	})
+	writeThrough.OrderPublished(order)
+	if _, found := writeThrough.GetOrder("a"); found {
+		t.Fatal("write-through cache caches unsaved order")
+	}
+	writeThrough.OrderSaved(order)
+	if _, found := writeThrough.GetOrder("a"); !found {
+		t.Fatal("write-through cache doesn't cache saved order")
+	}
+}
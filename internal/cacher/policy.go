@@ -0,0 +1,162 @@
+package cacher
+
+import (
+	"container/heap"
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+)
+
+// ErrUnknownPolicy -- the configured eviction policy isn't supported.
+var ErrUnknownPolicy = errors.New("unknown cache eviction policy")
+
+// Policy -- decides which order is evicted when the cache exceeds its bounds. Implementations aren't safe for concurrent use, Cacher
+// calls them under its mutex.
+type Policy interface {
+	// Add -- records newly cached or overwritten key.
+	Add(key string)
+	// Access -- records a cache hit of the key.
+	Access(key string)
+	// Remove -- forgets the key. Removing unknown key is a no-op.
+	Remove(key string)
+	// Victim -- returns the key to be evicted next, false if there are no keys.
+	Victim() (string, bool)
+}
+
+// NewPolicy -- returns Policy by its config name.
+func NewPolicy(name string) (Policy, error) {
+	switch name {
+	case config.CachePolicyLRU, config.CachePolicyTTLLRU:
+		return newLRU(), nil
+	case config.CachePolicyLFU:
+		return newLFU(), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPolicy, name)
+	}
+}
+
+// lru -- evicts the least recently used key. The most recent key is at the front of the list.
+type lru struct {
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+func (p *lru) Add(key string) {
+	if el, ok := p.keys[key]; ok {
+		p.order.MoveToFront(el)
+		return
+	}
+	p.keys[key] = p.order.PushFront(key)
+}
+
+func (p *lru) Access(key string) {
+	if el, ok := p.keys[key]; ok {
+		p.order.MoveToFront(el)
+	}
+}
+
+func (p *lru) Remove(key string) {
+	if el, ok := p.keys[key]; ok {
+		p.order.Remove(el)
+		delete(p.keys, key)
+	}
+}
+
+func (p *lru) Victim() (string, bool) {
+	el := p.order.Back()
+	if el == nil {
+		return "", false
+	}
+	return el.Value.(string), true
+}
+
+// lfu -- evicts the least frequently used key, the least recently used one among equally used keys.
+type lfu struct {
+	entries lfuHeap
+	keys    map[string]*lfuEntry
+	tick    uint64
+}
+
+type lfuEntry struct {
+	key   string
+	hits  uint64
+	tick  uint64
+	index int
+}
+
+func newLFU() *lfu {
+	return &lfu{keys: make(map[string]*lfuEntry)}
+}
+
+func (p *lfu) Add(key string) {
+	if _, ok := p.keys[key]; ok {
+		p.Access(key)
+		return
+	}
+	p.tick++
+	e := &lfuEntry{key: key, hits: 1, tick: p.tick}
+	p.keys[key] = e
+	heap.Push(&p.entries, e)
+}
+
+func (p *lfu) Access(key string) {
+	e, ok := p.keys[key]
+	if !ok {
+		return
+	}
+	p.tick++
+	e.hits++
+	e.tick = p.tick
+	heap.Fix(&p.entries, e.index)
+}
+
+func (p *lfu) Remove(key string) {
+	if e, ok := p.keys[key]; ok {
+		heap.Remove(&p.entries, e.index)
+		delete(p.keys, key)
+	}
+}
+
+func (p *lfu) Victim() (string, bool) {
+	if len(p.entries) == 0 {
+		return "", false
+	}
+	return p.entries[0].key, true
+}
+
+// lfuHeap -- is a min-heap of entries by hits, then by the last access.
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].hits != h[j].hits {
+		return h[i].hits < h[j].hits
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,34 @@
+package cacher
+
+import (
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"unsafe"
+)
+
+var (
+	orderSize = int64(unsafe.Sizeof(storage.Order{}))
+	itemSize  = int64(unsafe.Sizeof(storage.Item{}))
+)
+
+// sizeOf -- approximates the memory held by the order: its structs plus the bytes of its strings. Map and allocator overhead is
+// ignored, so max bytes setting is a soft bound.
+func sizeOf(o *storage.Order) int64 {
+	size := orderSize + strLen(o.OrderID, o.TrackNum, o.Entry, o.Locale, o.InternalSignature, o.CustomerId, o.DeliveryService,
+		o.Shardkey, o.OofShard, string(o.Status))
+	size += strLen(o.Delivery.Name, o.Delivery.Phone, o.Delivery.Zip, o.Delivery.City, o.Delivery.Address, o.Delivery.Region,
+		o.Delivery.Email)
+	size += strLen(o.Payment.Transaction, o.Payment.ReqID, o.Payment.Currency, o.Payment.Provider, o.Payment.Bank)
+	for i := range o.Items {
+		item := &o.Items[i]
+		size += itemSize + strLen(item.TrackNumber, item.Rid, item.Name, item.Size, item.Brand)
+	}
+	return size
+}
+
+func strLen(strs ...string) int64 {
+	var n int64
+	for _, s := range strs {
+		n += int64(len(s))
+	}
+	return n
+}
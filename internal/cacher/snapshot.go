@@ -0,0 +1,133 @@
+package cacher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot format: snapshotMagic, big-endian uint16 version and gzip-compressed JSON of snapshot.
+const snapshotVersion uint16 = 1
+
+var snapshotMagic = []byte("L0CS")
+
+var (
+	// ErrSnapshotCorrupted -- the snapshot isn't a cache snapshot or is truncated.
+	ErrSnapshotCorrupted = errors.New("cache snapshot is corrupted")
+	// ErrSnapshotVersion -- the snapshot has been written by an incompatible version of the service.
+	ErrSnapshotVersion = errors.New("unsupported cache snapshot version")
+	// ErrUnknownSnapshot -- the configured snapshot mode isn't supported by Cacher or its Storage.
+	ErrUnknownSnapshot = errors.New("unknown cache snapshot mode")
+)
+
+// SnapshotStore -- keeps the last cache snapshot. SaveSnapshot must replace the previous snapshot atomically, LoadSnapshot returns
+// storage.ErrSnapshotNotFound if nothing has been saved yet.
+type SnapshotStore interface {
+	SaveSnapshot(data []byte) error
+	LoadSnapshot() ([]byte, error)
+}
+
+// snapshot -- is the whole cache content. TTL is the time the order had left before expiration, 0 if it never expires.
+type snapshot struct {
+	CreatedAt time.Time       `json:"created_at"`
+	Entries   []snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Order storage.Order `json:"order"`
+	TTL   time.Duration `json:"ttl,omitempty"`
+}
+
+func encodeSnapshot(snap *snapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(snapshotMagic)
+	_ = binary.Write(&buf, binary.BigEndian, snapshotVersion)
+
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(snap); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSnapshot(data []byte) (*snapshot, error) {
+	header := len(snapshotMagic) + 2
+	if len(data) < header || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return nil, ErrSnapshotCorrupted
+	}
+	if version := binary.BigEndian.Uint16(data[len(snapshotMagic):header]); version != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, version)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data[header:]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSnapshotCorrupted, err)
+	}
+	defer zr.Close()
+
+	var snap snapshot
+	if err = json.NewDecoder(zr).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSnapshotCorrupted, err)
+	}
+	return &snap, nil
+}
+
+// fileSnapshots -- keeps the snapshot in a file. It's written to a temporary file in the same directory first and then renamed,
+// so a crash never leaves a partially written snapshot.
+type fileSnapshots struct {
+	path string
+}
+
+func (f *fileSnapshots) SaveSnapshot(data []byte) (err error) {
+	const op = "cacher.fileSnapshots.SaveSnapshot"
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (f *fileSnapshots) LoadSnapshot() ([]byte, error) {
+	const op = "cacher.fileSnapshots.LoadSnapshot"
+
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrSnapshotNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return data, nil
+}
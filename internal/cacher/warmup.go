@@ -0,0 +1,60 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"time"
+)
+
+// ErrUnknownWarmUp -- the configured warm-up strategy isn't supported.
+var ErrUnknownWarmUp = errors.New("unknown cache warm-up strategy")
+
+// load -- loads the newest orders for config.CacheWarmUpLatest or config.CacheWarmUpWindow strategy page by page, never more than
+// the cache holds. Returns the number of cached orders.
+func (c *Cacher) load(ctx context.Context) (int, error) {
+	const op = "cacher.load"
+
+	filter := storage.OrderFilter{}
+	limit := c.warmUp.WarmUpCount
+	if c.warmUp.WarmUp == config.CacheWarmUpWindow {
+		filter.CreatedFrom = time.Now().Add(-c.warmUp.WarmUpWindow)
+		limit = 0
+	}
+	if c.maxEntries > 0 && (limit <= 0 || limit > c.maxEntries) {
+		limit = c.maxEntries
+	}
+
+	batch := c.warmUp.WarmUpBatch
+	if batch <= 0 || batch > storage.MaxListLimit {
+		batch = storage.MaxListLimit
+	}
+
+	var orders []storage.Order
+	for {
+		filter.Limit = batch
+		if limit > 0 {
+			filter.Limit = min(batch, limit-len(orders))
+		}
+
+		page, next, err := c.db.ListOrders(ctx, filter)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		orders = append(orders, page...)
+		c.log.Debug("loaded warm-up batch", "orders", len(orders))
+
+		if next == "" || (limit > 0 && len(orders) >= limit) {
+			break
+		}
+		filter.Cursor = next
+	}
+
+	// orders are listed from the newest, so the oldest are cached first and are the first to be evicted
+	for i := len(orders) - 1; i >= 0; i-- {
+		c.CacheOrder(orders[i])
+	}
+	return len(orders), nil
+}
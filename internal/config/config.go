@@ -9,9 +9,96 @@ import (
 )
 
 type Config struct {
-	Nats     Nats     `yaml:"nats"`
-	DbConfig DbConfig `yaml:"dbConfig" env-required:"true"`
-	Server   Server   `yaml:"server"`
+	Nats      Nats      `yaml:"nats"`
+	DbConfig  DbConfig  `yaml:"dbConfig" env-required:"true"`
+	Server    Server    `yaml:"server"`
+	Tracing   Tracing   `yaml:"tracing"`
+	Log       Log       `yaml:"log"`
+	Cache     Cache     `yaml:"cache"`
+	Retention Retention `yaml:"retention"`
+}
+
+type Cache struct {
+	// Policy is one of CachePolicyLRU, CachePolicyLFU or CachePolicyTTLLRU. TTL is applied by CachePolicyTTLLRU only, expired
+	// orders are purged every PurgeInterval. MaxEntries and MaxBytes bound the cache, 0 means unbounded; bytes are approximate.
+	Policy        string        `yaml:"policy" env-default:"ttl-lru"`
+	TTL           time.Duration `yaml:"ttl" env-default:"1m"`
+	PurgeInterval time.Duration `yaml:"purge_interval" env-default:"3m"`
+	MaxEntries    int           `yaml:"max_entries" env-default:"10000"`
+	MaxBytes      int64         `yaml:"max_bytes" env-default:"67108864"`
+	// Snapshot is one of CacheSnapshotNone, CacheSnapshotFile or CacheSnapshotDB. With CacheSnapshotNone, or if the snapshot can't
+	// be read, cached uuids are backed up to and restored from the cached table one by one. SnapshotFile is used by CacheSnapshotFile.
+	Snapshot     string `yaml:"snapshot" env-default:"none"`
+	SnapshotFile string `yaml:"snapshot_file" env-default:"cache.snapshot"`
+	// BackupInterval -- cached orders are backed up every BackupInterval and once more on shutdown.
+	BackupInterval time.Duration `yaml:"backup_interval" env-default:"5m"`
+	// WarmUp is one of CacheWarmUpNone, CacheWarmUpBackup, CacheWarmUpLatest or CacheWarmUpWindow. Orders are loaded from the storage
+	// WarmUpBatch at a time, at most MaxEntries of them.
+	WarmUp       string        `yaml:"warm_up" env-default:"backup"`
+	WarmUpCount  int           `yaml:"warm_up_count" env-default:"1000"`
+	WarmUpWindow time.Duration `yaml:"warm_up_window" env-default:"24h"`
+	WarmUpBatch  int           `yaml:"warm_up_batch" env-default:"500"`
+	// Consistency is CacheConsistencyOptimistic or CacheConsistencyWriteThrough.
+	Consistency string `yaml:"consistency" env-default:"optimistic"`
+}
+
+const (
+	// CachePolicyLRU -- orders never expire, the least recently used one is evicted when the cache is full.
+	CachePolicyLRU = "lru"
+	// CachePolicyLFU -- orders never expire, the least frequently used one is evicted when the cache is full.
+	CachePolicyLFU = "lfu"
+	// CachePolicyTTLLRU -- orders expire after TTL, the least recently used one is evicted when the cache is full.
+	CachePolicyTTLLRU = "ttl-lru"
+)
+
+const (
+	CacheSnapshotNone = "none"
+	// CacheSnapshotFile -- the snapshot is written to a temporary file renamed over SnapshotFile.
+	CacheSnapshotFile = "file"
+	// CacheSnapshotDB -- the snapshot is kept in the single row of cache_snapshot table.
+	CacheSnapshotDB = "db"
+)
+
+const (
+	// CacheWarmUpNone -- the service starts with empty cache.
+	CacheWarmUpNone = "none"
+	// CacheWarmUpBackup -- orders are restored from the snapshot or the cached table.
+	CacheWarmUpBackup = "backup"
+	// CacheWarmUpLatest -- WarmUpCount newest orders by date_created are loaded.
+	CacheWarmUpLatest = "latest"
+	// CacheWarmUpWindow -- orders created within the last WarmUpWindow are loaded.
+	CacheWarmUpWindow = "window"
+)
+
+const (
+	// CacheConsistencyOptimistic -- orders are cached before they are published and removed from cache if they couldn't be saved.
+	CacheConsistencyOptimistic = "optimistic"
+	// CacheConsistencyWriteThrough -- orders are cached only after Saver has committed them.
+	CacheConsistencyWriteThrough = "write-through"
+)
+
+type Retention struct {
+	// Days -- orders created more than Days ago are archived and purged every Interval, Batch orders per transaction. 0 disables
+	// retention.
+	Days     int           `yaml:"days" env-default:"0"`
+	Interval time.Duration `yaml:"interval" env-default:"1h"`
+	Batch    int           `yaml:"batch" env-default:"500"`
+	// Archive is RetentionArchiveTable or RetentionArchiveFile. Dir is used by RetentionArchiveFile.
+	Archive string `yaml:"archive" env-default:"table"`
+	Dir     string `yaml:"dir" env-default:"archive"`
+}
+
+const (
+	// RetentionArchiveTable -- orders are moved to order_archive table.
+	RetentionArchiveTable = "table"
+	// RetentionArchiveFile -- every batch is written to a gzipped NDJSON file in Dir.
+	RetentionArchiveFile = "file"
+)
+
+type Log struct {
+	// Level is one of debug, info, warn or error, Format -- json or text.
+	Level  string `yaml:"level" env-default:"info"`
+	Format string `yaml:"format" env-default:"json"`
 }
 
 type DbConfig struct {
@@ -19,16 +106,71 @@ type DbConfig struct {
 	DbPass  string `yaml:"password" env-required:"true"`
 	DbName  string `yaml:"dbName" env-required:"true"`
 	SSLmode string `yaml:"sslmode"`
+	// Migrate -- applies pending migrations on startup, otherwise they are applied by the migrate subcommand.
+	Migrate bool `yaml:"migrate" env-default:"true"`
+	// SoftDelete -- deleted orders are kept with deleted_at timestamp for audit and hidden from reads, otherwise they are removed.
+	SoftDelete bool `yaml:"soft_delete" env-default:"false"`
 }
 
 type Server struct {
 	Timeout     time.Duration `yaml:"timeout" env-default:"5s"`
 	IdleTimeout time.Duration `yaml:"idle_timeout" env-default:"60s"`
 	Address     string        `yaml:"address" env-default:"localhost:8080"`
+	// ReadMode chooses where orders missing in cache are looked up: ReadModeDirect or ReadModeNats. LookupTimeout bounds the lookup.
+	ReadMode      string        `yaml:"read_mode" env-default:"direct"`
+	LookupTimeout time.Duration `yaml:"lookup_timeout" env-default:"3s"`
+	// BatchTimeout bounds saving the batch of orders. It must be less than Timeout, which cuts the response off.
+	BatchTimeout time.Duration `yaml:"batch_timeout" env-default:"4s"`
+	// ShutdownTimeout bounds the whole graceful shutdown: draining requests and subscriptions, final cache backup and closing db.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env-default:"15s"`
+}
+
+const (
+	// ReadModeDirect -- orders are read from the storage by the HTTP handler itself.
+	ReadModeDirect = "direct"
+	// ReadModeNats -- orders are requested over NATS request/reply from the GetHandler responder.
+	ReadModeNats = "nats"
+)
+
+type Tracing struct {
+	// Exporter is one of TracingNone, TracingOTLP, TracingStdout or TracingFile. Endpoint is the OTLP/HTTP collector address,
+	// File -- the path spans are written to by TracingFile.
+	Exporter    string  `yaml:"exporter" env-default:"none"`
+	Endpoint    string  `yaml:"endpoint" env-default:"localhost:4318"`
+	Insecure    bool    `yaml:"insecure" env-default:"true"`
+	File        string  `yaml:"file" env-default:"traces.json"`
+	ServiceName string  `yaml:"service_name" env-default:"l0-orders"`
+	SampleRatio float64 `yaml:"sample_ratio" env-default:"1"`
 }
 
+const (
+	TracingNone   = "none"
+	TracingOTLP   = "otlp"
+	TracingStdout = "stdout"
+	TracingFile   = "file"
+)
+
 type Nats struct {
-	IpAddr string `yaml:"ipaddr"`
+	IpAddr    string `yaml:"ipaddr"`
+	ClusterID string `yaml:"cluster_id" env-default:"test-cluster"`
+	ClientID  string `yaml:"client_id" env-default:"db-saver"`
+	// DurableName and QueueGroup identify the saveOrder subscription, so restarted service continues from the last acked message.
+	DurableName string        `yaml:"durable_name" env-default:"order-saver"`
+	QueueGroup  string        `yaml:"queue_group" env-default:"order-savers"`
+	AckWait     time.Duration `yaml:"ack_wait" env-default:"30s"`
+	MaxInflight int           `yaml:"max_inflight" env-default:"64"`
+	// DeadLetter is the subject receiving orders which couldn't be decoded or persisted after MaxRetries attempts. The failed
+	// order is republished after RetryBackoff, multiplied by RetryFactor for every next attempt up to RetryBackoffMax, which must
+	// be less than AckWait. AckWait bounds every attempt.
+	DeadLetter      string        `yaml:"dead_letter" env-default:"saveOrder.dlq"`
+	MaxRetries      int           `yaml:"max_retries" env-default:"3"`
+	RetryBackoff    time.Duration `yaml:"retry_backoff" env-default:"1s"`
+	RetryFactor     float64       `yaml:"retry_factor" env-default:"2"`
+	RetryBackoffMax time.Duration `yaml:"retry_backoff_max" env-default:"10s"`
+	// StatusEvents is the subject order status transitions are published to.
+	StatusEvents string `yaml:"status_events" env-default:"orderStatus"`
+	// DeleteDurableName identifies the deleteOrder subscription, which joins QueueGroup as well.
+	DeleteDurableName string `yaml:"delete_durable_name" env-default:"order-deleter"`
 }
 
 const op = "config.MustLoad: "
@@ -36,24 +178,30 @@ const op = "config.MustLoad: "
 // MustLoad -- looks for the config by CONFIG_PATH .env variable and marshals .yaml config to Config. Your project must contain local.env file with CONFIG_PATH variable.
 func MustLoad() *Config {
 	if err := godotenv.Load("local.env"); err != nil {
-		slog.Error(op, err)
+		slog.Error(op+"couldn't load local.env", "err", err)
 		os.Exit(1)
 	}
 
 	configPath := os.Getenv("CONFIG_PATH")
 	if configPath == "" {
-		slog.Error(op, "config path is empty")
+		slog.Error(op + "config path is empty")
 		os.Exit(1)
 	}
 
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		slog.Error(op, "config file doesn't exist", err)
+		slog.Error(op+"config file doesn't exist", "path", configPath)
 		os.Exit(1)
 	}
 
 	var cfg Config
 	if err := cleanenv.ReadConfig(configPath, &cfg); err != nil {
-		slog.Error(op, "couldn't read config", err)
+		slog.Error(op+"couldn't read config", "err", err)
+		os.Exit(1)
+	}
+
+	if cfg.Server.BatchTimeout >= cfg.Server.Timeout {
+		slog.Error(op+"server batch_timeout must be less than timeout", "batch_timeout", cfg.Server.BatchTimeout,
+			"timeout", cfg.Server.Timeout)
 		os.Exit(1)
 	}
 
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// MaxBatchSize -- is the maximum number of orders in one batch.
+	MaxBatchSize = 10000
+	// maxBatchLine -- is the maximum size of an NDJSON line.
+	maxBatchLine = 1 << 20
+)
+
+// Statuses of BatchResult.
+const (
+	BatchCreated   = "created"
+	BatchDuplicate = "duplicate"
+	BatchConflict  = "conflict"
+	BatchInvalid   = "invalid"
+	BatchFailed    = "failed"
+)
+
+// BatchResult -- is the outcome of one order of the batch. Index is the position of the order in the request, Error with its
+// Details -- the reason the order hasn't been created.
+type BatchResult struct {
+	Index   int    `json:"index"`
+	OrderID string `json:"order_uid,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Details any    `json:"details,omitempty"`
+}
+
+// BatchResponse -- holds the result of every order of the batch in the request order and the number of orders by status.
+type BatchResponse struct {
+	Results []BatchResult  `json:"results"`
+	Counts  map[string]int `json:"counts"`
+}
+
+var errBatchTooLarge = errors.New("batch has more than " + strconv.Itoa(MaxBatchSize) + " orders")
+
+// CreateBatch -- saves the batch of orders sent as a JSON array or NDJSON stream (Content-Type application/x-ndjson). Every order
+// is validated, valid ones are saved in one bulk write. Responds 200 with BatchResponse, even if some orders have failed.
+func (o *Orders) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	var raws []json.RawMessage
+	var err error
+	if isNDJSON(r.Header.Get("Content-Type")) {
+		raws, err = readNDJSON(r.Body)
+	} else {
+		raws, err = readJSONArray(r.Body)
+	}
+	switch {
+	case errors.Is(err, errBatchTooLarge):
+		SendError(w, http.StatusRequestEntityTooLarge, CodeBadRequest, err.Error())
+		return
+	case err != nil:
+		SendError(w, http.StatusBadRequest, CodeBadRequest, "couldn't decode batch: "+err.Error())
+		return
+	}
+
+	results := make([]BatchResult, len(raws))
+	orders := make([]storage.Order, 0, len(raws))
+	indexes := make([]int, 0, len(raws))
+	for i, raw := range raws {
+		results[i].Index = i
+		var order storage.Order
+		if err = json.Unmarshal(raw, &order); err != nil {
+			results[i].Status, results[i].Error = BatchInvalid, "couldn't decode order: "+err.Error()
+			continue
+		}
+		results[i].OrderID = order.OrderID
+		if err = order.Validate(); err != nil {
+			results[i].Status, results[i].Error = BatchInvalid, "invalid order"
+			var validationErr *storage.ValidationError
+			if errors.As(err, &validationErr) {
+				results[i].Details = validationErr.Fields
+			}
+			continue
+		}
+		order.Status, order.Version = storage.StatusCreated, storage.FirstVersion
+		orders = append(orders, order)
+		indexes = append(indexes, i)
+	}
+
+	if len(orders) != 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), o.batchTimeout)
+		defer cancel()
+		errs := o.db.SaveOrders(ctx, orders)
+		for j, err := range errs {
+			result := &results[indexes[j]]
+			switch {
+			case err == nil:
+				result.Status = BatchCreated
+				o.cache.OrderSaved(orders[j])
+			case errors.Is(err, storage.ErrDuplicateOrder):
+				result.Status = BatchDuplicate
+				// the batch hasn't saved this order, so it doesn't keep its copy in cache, as Saver doesn't for duplicates
+				o.cache.Delete(orders[j].OrderID)
+			case errors.Is(err, storage.ErrOrderConflict):
+				result.Status, result.Error = BatchConflict, "order with the same order_uid and different content already exists"
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				result.Status, result.Error = BatchFailed, "saving the batch timed out"
+			default:
+				o.log.ErrorContext(r.Context(), "couldn't save order of the batch", "order_uid", result.OrderID, logger.Err(err))
+				result.Status, result.Error = BatchFailed, "couldn't save order"
+			}
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	SendJson(w, http.StatusOK, BatchResponse{Results: results, Counts: counts})
+}
+
+func isNDJSON(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/x-ndjson" || mediaType == "application/ndjson" || mediaType == "application/jsonl"
+}
+
+// readJSONArray -- reads the elements of the JSON array without decoding them, so an order of wrong types fails alone.
+func readJSONArray(body io.Reader) ([]json.RawMessage, error) {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, errors.New("batch must be a JSON array")
+	}
+
+	var raws []json.RawMessage
+	for dec.More() {
+		if len(raws) == MaxBatchSize {
+			return nil, errBatchTooLarge
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		raws = append(raws, raw)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return raws, nil
+}
+
+// readNDJSON -- reads the orders line by line, skipping blank lines.
+func readNDJSON(body io.Reader) ([]json.RawMessage, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchLine)
+
+	var raws []json.RawMessage
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(raws) == MaxBatchSize {
+			return nil, errBatchTooLarge
+		}
+		raws = append(raws, json.RawMessage(bytes.Clone(line)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return raws, nil
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCache -- Cache keeping the orders in a map.
+type fakeCache struct {
+	mu     sync.Mutex
+	orders map[string]storage.Order
+}
+
+func newFakeCache() *fakeCache {
+	return &fakeCache{orders: make(map[string]storage.Order)}
+}
+
+func (c *fakeCache) CacheOrder(order storage.Order) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.orders[order.OrderID] = order
+}
+
+func (c *fakeCache) OrderPublished(order storage.Order) { c.CacheOrder(order) }
+func (c *fakeCache) OrderSaved(order storage.Order)     { c.CacheOrder(order) }
+func (c *fakeCache) OrderFailed(uuid string)            { c.Delete(uuid) }
+
+func (c *fakeCache) GetOrder(uuid string) (*storage.Order, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	order, ok := c.orders[uuid]
+	return &order, ok
+}
+
+func (c *fakeCache) Delete(uuid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.orders, uuid)
+}
+
+// fakeStorage -- Storage with the methods under test overridden, the rest panic.
+type fakeStorage struct {
+	Storage
+	saveOrders func(ctx context.Context, orders []storage.Order) []error
+	getOrder   func(ctx context.Context, uuid string) (*storage.Order, error)
+	delete     func(ctx context.Context, uuid string) error
+}
+
+func (s *fakeStorage) Delete(ctx context.Context, uuid string) error {
+	return s.delete(ctx, uuid)
+}
+
+func (s *fakeStorage) GetOrder(ctx context.Context, uuid string) (*storage.Order, error) {
+	return s.getOrder(ctx, uuid)
+}
+
+func (s *fakeStorage) SaveOrders(ctx context.Context, orders []storage.Order) []error {
+	return s.saveOrders(ctx, orders)
+}
+
+func newTestOrders(db Storage, cache Cache, timeout time.Duration) *Orders {
+	return NewOrders(cache, db, nil, nil, timeout, timeout, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestReadJSONArray(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		wantErr bool
+	}{
+		{"empty array", `[]`, 0, false},
+		{"orders", `[{"order_uid":"a"}, {"order_uid":"b"}]`, 2, false},
+		{"element of wrong type is kept", `[{"order_uid":"a"}, 42, "b"]`, 3, false},
+		{"not an array", `{"order_uid":"a"}`, 0, true},
+		{"broken element", `[{"order_uid":"a"}, {"order_uid":]`, 0, true},
+		{"unterminated", `[{"order_uid":"a"}`, 0, true},
+		{"empty body", ``, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raws, err := readJSONArray(strings.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readJSONArray() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(raws) != tt.want {
+				t.Fatalf("readJSONArray() read %d elements, want %d", len(raws), tt.want)
+			}
+		})
+	}
+}
+
+func TestReadNDJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr error
+	}{
+		{"orders", "{\"order_uid\":\"a\"}\n{\"order_uid\":\"b\"}\n", []string{`{"order_uid":"a"}`, `{"order_uid":"b"}`}, nil},
+		{"blank lines and CRLF", "\n  \r\n{\"order_uid\":\"a\"}\r\n\n", []string{`{"order_uid":"a"}`}, nil},
+		{"no trailing newline", `{"order_uid":"a"}`, []string{`{"order_uid":"a"}`}, nil},
+		{"broken line is kept to fail alone", "{\"order_uid\":\n{\"order_uid\":\"b\"}", []string{`{"order_uid":`, `{"order_uid":"b"}`}, nil},
+		{"line too long", `{"name":"` + strings.Repeat("x", maxBatchLine) + `"}`, nil, bufio.ErrTooLong},
+		{"empty body", "", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raws, err := readNDJSON(strings.NewReader(tt.body))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readNDJSON() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(raws) != len(tt.want) {
+				t.Fatalf("readNDJSON() read %d lines, want %d", len(raws), len(tt.want))
+			}
+			for i := range raws {
+				if string(raws[i]) != tt.want[i] {
+					t.Fatalf("line %d = %s, want %s", i, raws[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadBatchSizeLimit(t *testing.T) {
+	array := func(n int) string { return "[" + strings.TrimSuffix(strings.Repeat("{},", n), ",") + "]" }
+	lines := func(n int) string { return strings.Repeat("{}\n\n", n) }
+
+	if raws, err := readJSONArray(strings.NewReader(array(MaxBatchSize))); err != nil || len(raws) != MaxBatchSize {
+		t.Fatalf("readJSONArray() of the largest batch = %d, %v", len(raws), err)
+	}
+	if _, err := readJSONArray(strings.NewReader(array(MaxBatchSize + 1))); !errors.Is(err, errBatchTooLarge) {
+		t.Fatalf("readJSONArray() error = %v, want errBatchTooLarge", err)
+	}
+	if raws, err := readNDJSON(strings.NewReader(lines(MaxBatchSize))); err != nil || len(raws) != MaxBatchSize {
+		t.Fatalf("readNDJSON() of the largest batch = %d, %v", len(raws), err)
+	}
+	if _, err := readNDJSON(strings.NewReader(lines(MaxBatchSize + 1))); !errors.Is(err, errBatchTooLarge) {
+		t.Fatalf("readNDJSON() error = %v, want errBatchTooLarge", err)
+	}
+}
+
+func TestCreateBatchTimeout(t *testing.T) {
+	db := &fakeStorage{saveOrders: func(ctx context.Context, orders []storage.Order) []error {
+		<-ctx.Done()
+		errs := make([]error, len(orders))
+		for i := range errs {
+			errs[i] = ctx.Err()
+		}
+		return errs
+	}}
+	o := newTestOrders(db, newFakeCache(), time.Second)
+	o.batchTimeout = 10 * time.Millisecond
+
+	body, _ := json.Marshal([]*storage.Order{storage.RandomOrder("a"), storage.RandomOrder("b")})
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		o.CreateBatch(w, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("CreateBatch isn't bounded by timeout")
+	}
+
+	var resp BatchResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Counts[BatchFailed] != 2 {
+		t.Fatalf("counts = %v, want 2 failed", resp.Counts)
+	}
+	for _, result := range resp.Results {
+		if result.Error != "saving the batch timed out" {
+			t.Fatalf("result = %+v", result)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	natsServer "github.com/wlcmtunknwndth/L0_WB/internal/nats-server"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+type DeadLetterQueue interface {
+	DeadLetters() []natsServer.DeadLetterEntry
+	DeadLetter(seq uint64) (natsServer.DeadLetterEntry, error)
+	Replay(ctx context.Context, seq uint64) error
+}
+
+// DeadLetters -- serves the dead-letter queue of orders which couldn't be decoded or saved.
+type DeadLetters struct {
+	log *slog.Logger
+	dlq DeadLetterQueue
+}
+
+// NewDeadLetters -- creates new instance of DeadLetters.
+func NewDeadLetters(dlq DeadLetterQueue, log *slog.Logger) *DeadLetters {
+	return &DeadLetters{dlq: dlq, log: log.With("component", "handlers.dlq")}
+}
+
+// Routes -- returns the router of the dead-letter queue, which must be mounted to /dlq.
+func (d *DeadLetters) Routes() chi.Router {
+	router := chi.NewRouter()
+	router.Get("/", d.List)
+	router.Get("/{seq}", d.Get)
+	router.Post("/{seq}/replay", d.Replay)
+	return router
+}
+
+// List -- sends all the dead letters.
+func (d *DeadLetters) List(w http.ResponseWriter, r *http.Request) {
+	SendJson(w, http.StatusOK, d.dlq.DeadLetters())
+}
+
+// Get -- sends the dead letter with the sequence in URL.
+func (d *DeadLetters) Get(w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.ParseUint(chi.URLParam(r, "seq"), 10, 64)
+	if err != nil {
+		SendError(w, http.StatusBadRequest, CodeBadRequest, "sequence must be a number")
+		return
+	}
+
+	entry, err := d.dlq.DeadLetter(seq)
+	if err != nil {
+		SendError(w, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	SendJson(w, http.StatusOK, entry)
+}
+
+// Replay -- publishes the payload of the dead letter with the sequence in URL back to the SaveOrder channel.
+func (d *DeadLetters) Replay(w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.ParseUint(chi.URLParam(r, "seq"), 10, 64)
+	if err != nil {
+		SendError(w, http.StatusBadRequest, CodeBadRequest, "sequence must be a number")
+		return
+	}
+
+	if err = d.dlq.Replay(r.Context(), seq); err != nil {
+		if errors.Is(err, natsServer.ErrDeadLetterNotFound) {
+			SendError(w, http.StatusNotFound, CodeNotFound, err.Error())
+			return
+		}
+		d.log.ErrorContext(r.Context(), "couldn't replay dead letter", "seq", seq, logger.Err(err))
+		SendError(w, http.StatusInternalServerError, CodeInternal, "couldn't replay dead letter")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check -- checks if a single component of the service is usable, returns nil if it is.
+type Check func(ctx context.Context) error
+
+// ComponentStatus -- is the result of the component's Check.
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthStatus -- is the body of liveness and readiness responses.
+type HealthStatus struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// Health -- serves liveness and readiness probes.
+type Health struct {
+	checks  map[string]Check
+	timeout time.Duration
+}
+
+// NewHealth -- creates new instance of Health. checks are run by the readiness probe by their names, each bounded by timeout.
+func NewHealth(timeout time.Duration, checks map[string]Check) *Health {
+	return &Health{checks: checks, timeout: timeout}
+}
+
+// Live -- responds 200 as long as the process is able to serve requests.
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	SendJson(w, http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// Ready -- runs all the checks concurrently and responds 200 if all of them have passed, 503 otherwise. The status of every
+// component is listed in the body.
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	status := HealthStatus{Status: "ready", Components: make(map[string]ComponentStatus, len(h.checks))}
+	for name, check := range h.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			component := ComponentStatus{Status: "ok"}
+			if err := check(ctx); err != nil {
+				component = ComponentStatus{Status: "down", Error: err.Error()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			status.Components[name] = component
+			if component.Error != "" {
+				status.Status = "not_ready"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	if status.Status != "ready" {
+		code = http.StatusServiceUnavailable
+	}
+	SendJson(w, code, status)
+}
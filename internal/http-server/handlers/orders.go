@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/go-chi/chi/v5"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Cache interface {
+	CacheOrder(order storage.Order)
+	OrderPublished(order storage.Order)
+	OrderFailed(uuid string)
+	GetOrder(uuid string) (*storage.Order, bool)
+	Delete(uuid string)
+	OrderSaved(order storage.Order)
+}
+
+type Storage interface {
+	GetOrder(ctx context.Context, uuid string) (*storage.Order, error)
+	ListOrders(ctx context.Context, filter storage.OrderFilter) ([]storage.Order, string, error)
+	Delete(ctx context.Context, uuid string) error
+	SaveOrders(ctx context.Context, orders []storage.Order) []error
+	UpdateStatus(ctx context.Context, uuid string, to storage.Status, reason string) (*storage.OrderEvent, error)
+	OrderEvents(ctx context.Context, uuid string) ([]storage.OrderEvent, error)
+	UpdateOrder(ctx context.Context, order *storage.Order, version int64) (*storage.Order, error)
+}
+
+// OrderList -- is the page of the order listing. NextCursor is passed as the cursor query parameter to get the next page, it is
+// empty on the last page.
+type OrderList struct {
+	Orders     []storage.Order `json:"orders"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+type Publisher interface {
+	PublishOrder(ctx context.Context, order []byte) error
+	PublishEvent(ctx context.Context, event storage.OrderEvent) error
+}
+
+// FetchFunc -- looks the order up by uuid when it is missing in cache. Must return storage.ErrOrderNotFound if there is no such order.
+type FetchFunc func(ctx context.Context, uuid string) (*storage.Order, error)
+
+// Orders -- serves the orders resource.
+type Orders struct {
+	log     *slog.Logger
+	cache   Cache
+	db      Storage
+	broker  Publisher
+	fetch   FetchFunc
+	timeout time.Duration
+	// batchTimeout -- bounds saving the whole batch, as it takes much longer than a single order
+	batchTimeout time.Duration
+}
+
+// NewOrders -- creates new instance of Orders. fetch is used for orders missing in cache, timeout bounds every storage call but
+// saving a batch, which is bounded by batchTimeout.
+func NewOrders(cache Cache, db Storage, broker Publisher, fetch FetchFunc, timeout, batchTimeout time.Duration,
+	log *slog.Logger) *Orders {
+	return &Orders{
+		log:          log.With("component", "handlers.orders"),
+		cache:        cache,
+		db:           db,
+		broker:       broker,
+		fetch:        fetch,
+		timeout:      timeout,
+		batchTimeout: batchTimeout,
+	}
+}
+
+// Routes -- returns the router of the orders resource, which must be mounted to /orders.
+func (o *Orders) Routes() chi.Router {
+	router := chi.NewRouter()
+	router.Get("/", o.List)
+	router.Post("/", o.Create)
+	router.Post("/batch", o.CreateBatch)
+	router.Get("/{order_uid}", o.Get)
+	router.Head("/{order_uid}", o.Head)
+	router.Put("/{order_uid}", o.Replace)
+	router.Patch("/{order_uid}", o.Patch)
+	router.Delete("/{order_uid}", o.Delete)
+	router.Patch("/{order_uid}/status", o.UpdateStatus)
+	router.Get("/{order_uid}/events", o.Events)
+	return router
+}
+
+// Create -- publishes the order from request body to be saved and caches it. Responds 201 with the order, 422 with the invalid
+// fields if the order hasn't passed validation and 409 if the order with such order_uid already exists.
+func (o *Orders) Create(w http.ResponseWriter, r *http.Request) {
+	var order storage.Order
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+		sendDecodeError(w, err)
+		return
+	}
+	if err := order.Validate(); err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	_, err := o.lookup(r.Context(), order.OrderID)
+	switch {
+	case err == nil:
+		SendError(w, http.StatusConflict, CodeConflict, "order "+order.OrderID+" already exists")
+		return
+	case !errors.Is(err, storage.ErrOrderNotFound):
+		o.sendLookupError(r.Context(), w, order.OrderID, err)
+		return
+	}
+
+	if err = o.publish(r.Context(), &order); err != nil {
+		SendError(w, http.StatusServiceUnavailable, CodeUnavailable, "couldn't publish order")
+		return
+	}
+
+	w.Header().Set("Location", "/orders/"+order.OrderID)
+	SendJson(w, http.StatusCreated, order)
+}
+
+// CreateRandom -- creates an order with random fields, publishes it to be saved and writes back its uuid.
+func (o *Orders) CreateRandom(w http.ResponseWriter, r *http.Request) {
+	order := storage.RandomOrder(gofakeit.UUID())
+
+	if err := o.publish(r.Context(), order); err != nil {
+		SendError(w, http.StatusServiceUnavailable, CodeUnavailable, "couldn't publish order")
+		return
+	}
+
+	if _, err := w.Write([]byte(order.OrderID)); err != nil {
+		o.log.ErrorContext(r.Context(), "couldn't write uuid", logger.Err(err))
+	}
+}
+
+// List -- sends the page of orders matching the query parameters: customer_id, track_number, delivery_service, bank, currency,
+// brand, created_from and created_to(RFC 3339), limit and cursor.
+func (o *Orders) List(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := storage.OrderFilter{
+		CustomerID:      query.Get("customer_id"),
+		TrackNumber:     query.Get("track_number"),
+		DeliveryService: query.Get("delivery_service"),
+		Bank:            query.Get("bank"),
+		Currency:        query.Get("currency"),
+		Brand:           query.Get("brand"),
+		Cursor:          query.Get("cursor"),
+	}
+
+	var err error
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 || filter.Limit > storage.MaxListLimit {
+			SendError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("limit must be a number from 1 to %d", storage.MaxListLimit))
+			return
+		}
+	}
+	for param, value := range map[string]*time.Time{"created_from": &filter.CreatedFrom, "created_to": &filter.CreatedTo} {
+		if raw := query.Get(param); raw != "" {
+			if *value, err = time.Parse(time.RFC3339, raw); err != nil {
+				SendError(w, http.StatusBadRequest, CodeBadRequest, param+" must be RFC 3339 time")
+				return
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), o.timeout)
+	defer cancel()
+
+	orders, next, err := o.db.ListOrders(ctx, filter)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		SendError(w, http.StatusBadRequest, CodeBadRequest, "invalid cursor")
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		SendError(w, http.StatusGatewayTimeout, CodeTimeout, "order listing timed out")
+		return
+	}
+	if err != nil {
+		o.log.ErrorContext(ctx, "couldn't list orders", logger.Err(err))
+		SendError(w, http.StatusInternalServerError, CodeInternal, "couldn't list orders")
+		return
+	}
+	SendJson(w, http.StatusOK, OrderList{Orders: orders, NextCursor: next})
+}
+
+// Get -- sends the order by order_uid in URL with its version as ETag.
+func (o *Orders) Get(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "order_uid")
+
+	order, err := o.lookup(r.Context(), uuid)
+	if err != nil {
+		o.sendLookupError(r.Context(), w, uuid, err)
+		return
+	}
+	setETag(w, order)
+	SendJson(w, http.StatusOK, order)
+}
+
+// GetByBody -- sends the order by uuid from storage.SearchRequest in request body.
+func (o *Orders) GetByBody(w http.ResponseWriter, r *http.Request) {
+	var searchReq storage.SearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&searchReq); err != nil {
+		SendError(w, http.StatusBadRequest, CodeBadRequest, "couldn't decode search request: "+err.Error())
+		return
+	}
+
+	order, err := o.lookup(r.Context(), searchReq.Uuid)
+	if err != nil {
+		o.sendLookupError(r.Context(), w, searchReq.Uuid, err)
+		return
+	}
+	SendJson(w, http.StatusOK, order)
+}
+
+// Head -- responds 200 with the order ETag if the order by order_uid in URL exists, 404 otherwise.
+func (o *Orders) Head(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "order_uid")
+
+	order, err := o.lookup(r.Context(), uuid)
+	if err != nil {
+		o.sendLookupError(r.Context(), w, uuid, err)
+		return
+	}
+	setETag(w, order)
+	w.WriteHeader(http.StatusOK)
+}
+
+// setETag -- sets ETag of the order version. Orders published but not saved yet have no version.
+func setETag(w http.ResponseWriter, order *storage.Order) {
+	if order.Version > 0 {
+		w.Header().Set("ETag", etag(order.Version))
+	}
+}
+
+// Delete -- deletes the order by order_uid in URL from storage and cache along with its backup. Responds 204 on success.
+func (o *Orders) Delete(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "order_uid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), o.timeout)
+	defer cancel()
+
+	if err := o.db.Delete(ctx, uuid); err != nil {
+		// the order could have been deleted by Deleter of another instance, leaving a stale copy here
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			o.cache.Delete(uuid)
+		}
+		o.sendLookupError(r.Context(), w, uuid, err)
+		return
+	}
+	o.cache.Delete(uuid)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lookup -- gets the order from cache if cached, otherwise fetches and caches it.
+func (o *Orders) lookup(ctx context.Context, uuid string) (*storage.Order, error) {
+	if order, found := o.cache.GetOrder(uuid); found {
+		return order, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	order, err := o.fetch(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	o.cache.CacheOrder(*order)
+	return order, nil
+}
+
+// publish -- publishes the order to be saved, the cache decides whether to cache it right away.
+func (o *Orders) publish(ctx context.Context, order *storage.Order) error {
+	ctx = logger.With(ctx, "order_uid", order.OrderID)
+	order.Status, order.Version = storage.StatusCreated, storage.FirstVersion
+	orderBytes, err := json.Marshal(order)
+	if err != nil {
+		o.log.ErrorContext(ctx, "couldn't encode order", logger.Err(err))
+		return err
+	}
+
+	o.cache.OrderPublished(*order)
+
+	if err = o.broker.PublishOrder(ctx, orderBytes); err != nil {
+		o.log.ErrorContext(ctx, "couldn't publish order", logger.Err(err))
+		o.cache.OrderFailed(order.OrderID)
+		return err
+	}
+	return nil
+}
+
+// sendLookupError -- maps the error of a storage call to the response status.
+func (o *Orders) sendLookupError(ctx context.Context, w http.ResponseWriter, uuid string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrOrderNotFound):
+		SendError(w, http.StatusNotFound, CodeNotFound, "order "+uuid+" not found")
+	case errors.Is(err, context.DeadlineExceeded):
+		o.log.ErrorContext(ctx, "order lookup timed out", "order_uid", uuid)
+		SendError(w, http.StatusGatewayTimeout, CodeTimeout, "order lookup timed out")
+	default:
+		o.log.ErrorContext(ctx, "couldn't get order", "order_uid", uuid, logger.Err(err))
+		SendError(w, http.StatusInternalServerError, CodeInternal, "couldn't get order")
+	}
+}
+
+// sendDecodeError -- responds 422 if the order has a field of the wrong type, e.g. a negative amount, and 400 if it isn't JSON at all.
+func sendDecodeError(w http.ResponseWriter, err error) {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		SendErrorDetails(w, http.StatusUnprocessableEntity, CodeUnprocessable, "invalid order", []storage.FieldError{{
+			Field:   typeErr.Field,
+			Message: "must be of type " + typeErr.Type.String() + ", got " + typeErr.Value,
+		}})
+		return
+	}
+	SendError(w, http.StatusBadRequest, CodeBadRequest, "couldn't decode order: "+err.Error())
+}
+
+// sendValidationError -- responds 422 with the invalid fields of the order.
+func sendValidationError(w http.ResponseWriter, err error) {
+	var validationErr *storage.ValidationError
+	if errors.As(err, &validationErr) {
+		SendErrorDetails(w, http.StatusUnprocessableEntity, CodeUnprocessable, "invalid order", validationErr.Fields)
+		return
+	}
+	SendError(w, http.StatusUnprocessableEntity, CodeUnprocessable, err.Error())
+}
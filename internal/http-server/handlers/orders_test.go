@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// softDeleteStorage -- keeps a single order and hides it from GetOrder once deleted, as the storage in soft-delete mode does.
+func softDeleteStorage(order *storage.Order) *fakeStorage {
+	var mu sync.Mutex
+	deleted := false
+	return &fakeStorage{
+		getOrder: func(ctx context.Context, uuid string) (*storage.Order, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if deleted || uuid != order.OrderID {
+				return nil, fmt.Errorf("fake: %s: %w", uuid, storage.ErrOrderNotFound)
+			}
+			return order, nil
+		},
+		delete: func(ctx context.Context, uuid string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if deleted || uuid != order.OrderID {
+				return fmt.Errorf("fake: %s: %w", uuid, storage.ErrOrderNotFound)
+			}
+			deleted = true
+			return nil
+		},
+	}
+}
+
+func TestDeleteOrder(t *testing.T) {
+	order := storage.RandomOrder("b563feb7b2b84b6test")
+	cache := newFakeCache()
+	db := softDeleteStorage(order)
+	o := newTestOrders(db, cache, time.Second)
+	o.fetch = db.GetOrder
+	router := o.Routes()
+
+	serve := func(method string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/"+order.OrderID, nil))
+		return w.Code
+	}
+
+	if code := serve(http.MethodGet); code != http.StatusOK {
+		t.Fatalf("GET before delete = %d, want 200", code)
+	}
+	if _, found := cache.GetOrder(order.OrderID); !found {
+		t.Fatal("order isn't cached by GET")
+	}
+
+	if code := serve(http.MethodDelete); code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want 204", code)
+	}
+	if _, found := cache.GetOrder(order.OrderID); found {
+		t.Fatal("deleted order is still cached")
+	}
+	if code := serve(http.MethodGet); code != http.StatusNotFound {
+		t.Fatalf("GET after delete = %d, want 404", code)
+	}
+	if code := serve(http.MethodDelete); code != http.StatusNotFound {
+		t.Fatalf("second DELETE = %d, want 404", code)
+	}
+}
+
+func TestDeleteMissingOrderDropsStaleCopy(t *testing.T) {
+	order := storage.RandomOrder("b563feb7b2b84b6test")
+	cache := newFakeCache()
+	cache.CacheOrder(*order)
+	// the order has been deleted by another instance, this one has a stale copy
+	db := &fakeStorage{delete: func(ctx context.Context, uuid string) error {
+		return fmt.Errorf("fake: %s: %w", uuid, storage.ErrOrderNotFound)
+	}}
+	router := newTestOrders(db, cache, time.Second).Routes()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/"+order.OrderID, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("DELETE = %d, want 404", w.Code)
+	}
+	if _, found := cache.GetOrder(order.OrderID); found {
+		t.Fatal("stale copy of the missing order is still cached")
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"log/slog"
+	"net/http"
+)
+
+// Codes of ErrorBody.
+const (
+	CodeBadRequest    = "bad_request"
+	CodeNotFound      = "not_found"
+	CodeConflict      = "conflict"
+	CodeUnprocessable = "unprocessable_entity"
+	CodeTimeout       = "timeout"
+	CodeInternal      = "internal"
+	CodeUnavailable   = "unavailable"
+)
+
+// ErrorResponse -- is the envelope of every error response.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorBody -- describes the error: Status duplicates the HTTP status code, Code is one of the Code* constants, Details are optional
+// error specific data.
+type ErrorBody struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+// SendJson -- marshals v and sends it to the http.ResponseWriter response body with the given status.
+func SendJson(w http.ResponseWriter, status int, v any) {
+	answer, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("couldn't marshal response", logger.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(answer); err != nil {
+		slog.Error("couldn't send response", logger.Err(err))
+	}
+}
+
+// SendError -- sends ErrorResponse with the given status.
+func SendError(w http.ResponseWriter, status int, code, message string) {
+	SendJson(w, status, ErrorResponse{Error: ErrorBody{Status: status, Code: code, Message: message}})
+}
+
+// SendErrorDetails -- sends ErrorResponse with the given status and details.
+func SendErrorDetails(w http.ResponseWriter, status int, code, message string, details any) {
+	SendJson(w, status, ErrorResponse{Error: ErrorBody{Status: status, Code: code, Message: message, Details: details}})
+}
+
+// Deprecated -- marks responses of the route as deprecated, pointing to the successor route.
+func Deprecated(successor string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"net/http"
+)
+
+// StatusRequest -- is the body of the status update: the status the order moves to and the optional reason of the transition.
+type StatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// UpdateStatus -- moves the order by order_uid in URL to the status from StatusRequest body and publishes the transition. Responds
+// 200 with the storage.OrderEvent, 422 if there is no such status and 409 if the order can't move to it from its current status.
+func (o *Orders) UpdateStatus(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "order_uid")
+
+	var req StatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, http.StatusBadRequest, CodeBadRequest, "couldn't decode status request: "+err.Error())
+		return
+	}
+	to, err := storage.ParseStatus(req.Status)
+	if err != nil {
+		SendErrorDetails(w, http.StatusUnprocessableEntity, CodeUnprocessable, err.Error(), []storage.FieldError{{
+			Field: "status", Message: "unknown status",
+		}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), o.timeout)
+	defer cancel()
+
+	event, err := o.db.UpdateStatus(ctx, uuid, to, req.Reason)
+	if errors.Is(err, storage.ErrIllegalTransition) {
+		SendError(w, http.StatusConflict, CodeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		o.sendLookupError(r.Context(), w, uuid, err)
+		return
+	}
+
+	// the transition bumps the order version, so the cached copy is reloaded rather than patched
+	if _, found := o.cache.GetOrder(uuid); found {
+		if order, err := o.db.GetOrder(ctx, uuid); err == nil {
+			o.refresh(order)
+		} else {
+			o.cache.Delete(uuid)
+		}
+	}
+
+	// the transition is committed, so failing to publish it doesn't fail the request
+	_ = o.broker.PublishEvent(r.Context(), *event)
+
+	SendJson(w, http.StatusOK, event)
+}
+
+// Events -- sends the status history of the order by order_uid in URL from its creation.
+func (o *Orders) Events(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "order_uid")
+
+	ctx, cancel := context.WithTimeout(r.Context(), o.timeout)
+	defer cancel()
+
+	events, err := o.db.OrderEvents(ctx, uuid)
+	if err != nil {
+		o.sendLookupError(r.Context(), w, uuid, err)
+		return
+	}
+	SendJson(w, http.StatusOK, events)
+}
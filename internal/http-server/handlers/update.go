@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CodePrecondition -- is the code of responses to the updates without If-Match or with a stale one.
+const CodePrecondition = "precondition_failed"
+
+// Replace -- replaces the order by order_uid in URL with the order from request body, if the order is of the version in If-Match
+// header. Status is changed by UpdateStatus only, so the one in body is ignored. Responds 200 with the updated order and its ETag,
+// 428 without If-Match, 412 if the order has been modified since or If-Match has no strong ETag and 422 if the order hasn't passed validation.
+func (o *Orders) Replace(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "order_uid")
+
+	version, ok := o.ifMatch(w, r, uuid)
+	if !ok {
+		return
+	}
+
+	var order storage.Order
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+		sendDecodeError(w, err)
+		return
+	}
+
+	o.update(w, r, &order, uuid, version)
+}
+
+// Patch -- applies JSON merge patch (RFC 7396) from request body to the order by order_uid in URL, if the order is of the version
+// in If-Match header. Responds as Replace does.
+func (o *Orders) Patch(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "order_uid")
+
+	version, ok := o.ifMatch(w, r, uuid)
+	if !ok {
+		return
+	}
+
+	var patch any
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&patch); err != nil {
+		SendError(w, http.StatusBadRequest, CodeBadRequest, "couldn't decode merge patch: "+err.Error())
+		return
+	}
+	if _, isObject := patch.(map[string]any); !isObject {
+		SendError(w, http.StatusBadRequest, CodeBadRequest, "merge patch must be a JSON object")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), o.timeout)
+	current, err := o.db.GetOrder(ctx, uuid)
+	cancel()
+	if err != nil {
+		o.sendLookupError(r.Context(), w, uuid, err)
+		return
+	}
+	if current.Version != version {
+		sendStale(w, uuid)
+		return
+	}
+
+	var target any
+	if target, err = toJSONValue(current); err != nil {
+		o.log.ErrorContext(r.Context(), "couldn't encode order", "order_uid", uuid, logger.Err(err))
+		SendError(w, http.StatusInternalServerError, CodeInternal, "couldn't patch order")
+		return
+	}
+	patched, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		o.log.ErrorContext(r.Context(), "couldn't encode patched order", "order_uid", uuid, logger.Err(err))
+		SendError(w, http.StatusInternalServerError, CodeInternal, "couldn't patch order")
+		return
+	}
+
+	var order storage.Order
+	if err = json.Unmarshal(patched, &order); err != nil {
+		sendDecodeError(w, err)
+		return
+	}
+
+	o.update(w, r, &order, uuid, version)
+}
+
+// update -- validates the order and saves it over the one by uuid of the given version, then refreshes the cached copy.
+func (o *Orders) update(w http.ResponseWriter, r *http.Request, order *storage.Order, uuid string, version int64) {
+	if order.OrderID != "" && order.OrderID != uuid {
+		SendErrorDetails(w, http.StatusUnprocessableEntity, CodeUnprocessable, "invalid order", []storage.FieldError{{
+			Field: "order_uid", Message: "can't be changed",
+		}})
+		return
+	}
+	// payment is joined to the order by its transaction
+	order.OrderID, order.Payment.Transaction = uuid, uuid
+	order.Status, order.Version = "", 0
+	if err := order.Validate(); err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), o.timeout)
+	defer cancel()
+
+	updated, err := o.db.UpdateOrder(ctx, order, version)
+	if errors.Is(err, storage.ErrVersionMismatch) {
+		sendStale(w, uuid)
+		return
+	}
+	if err != nil {
+		o.sendLookupError(r.Context(), w, uuid, err)
+		return
+	}
+	o.refresh(updated)
+
+	w.Header().Set("ETag", etag(updated.Version))
+	SendJson(w, http.StatusOK, updated)
+}
+
+// refresh -- replaces the cached copy of the order, so the order stays in the backup set. Orders missing in cache are left there.
+func (o *Orders) refresh(order *storage.Order) {
+	if _, found := o.cache.GetOrder(order.OrderID); found {
+		o.cache.CacheOrder(*order)
+	}
+}
+
+// ifMatch -- returns the order version from If-Match header. "*" matches the current version of the order, so does the list of
+// ETags containing it. Responds 428 and returns false if there is no If-Match, 412 if it has no strong ETag of the order or none
+// of the listed ones is current.
+func (o *Orders) ifMatch(w http.ResponseWriter, r *http.Request, uuid string) (int64, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		SendError(w, http.StatusPreconditionRequired, CodePrecondition, "If-Match header with the order ETag is required")
+		return 0, false
+	}
+
+	var versions []int64
+	if header != "*" {
+		versions = parseETags(header)
+		if len(versions) == 0 {
+			SendError(w, http.StatusPreconditionFailed, CodePrecondition, "If-Match has no strong ETag of the order")
+			return 0, false
+		}
+		if len(versions) == 1 {
+			return versions[0], true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), o.timeout)
+	defer cancel()
+	order, err := o.db.GetOrder(ctx, uuid)
+	if err != nil {
+		o.sendLookupError(r.Context(), w, uuid, err)
+		return 0, false
+	}
+	if versions == nil || slices.Contains(versions, order.Version) {
+		return order.Version, true
+	}
+	sendStale(w, uuid)
+	return 0, false
+}
+
+// parseETags -- returns the versions of the comma-separated ETags. Weak ETags are skipped, as If-Match uses the strong comparison,
+// so are the ones which aren't the order ETags.
+func parseETags(header string) []int64 {
+	var versions []int64
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		version, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+		if err != nil || version < 1 {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// sendStale -- responds 412 to the update of the order modified since the version in If-Match.
+func sendStale(w http.ResponseWriter, uuid string) {
+	SendError(w, http.StatusPreconditionFailed, CodePrecondition, "order "+uuid+" has been modified, get it again")
+}
+
+// etag -- returns the ETag of the order version.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// toJSONValue -- converts v to the generic JSON value mergePatch works with, keeping numbers exact.
+func toJSONValue(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err = dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// mergePatch -- applies JSON merge patch to target as RFC 7396 defines: objects are merged recursively, null removes the member,
+// any other value, arrays included, replaces the target.
+func mergePatch(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = make(map[string]any, len(patchObj))
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+			continue
+		}
+		targetObj[key] = mergePatch(targetObj[key], value)
+	}
+	return targetObj
+}
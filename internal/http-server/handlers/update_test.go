@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergePatch(t *testing.T) {
+	// the cases of RFC 7396, Appendix A, and the ones of the order documents
+	tests := []struct {
+		name, target, patch, want string
+	}{
+		{"replace member", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"add member", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{"null removes member", `{"a":"b"}`, `{"a":null}`, `{}`},
+		{"null removes one of members", `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{"array replaces value", `{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"value replaces array", `{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{"nested merge and removal", `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{"array of objects isn't merged", `{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{"null in target is kept", `{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{"non-object patch replaces target", `{"a":"foo"}`, `"bar"`, `"bar"`},
+		{"null patch replaces target", `{"a":"foo"}`, `null`, `null`},
+		{"object patch replaces non-object", `[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{"nested null into missing object", `{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{"items are replaced as a whole", `{"items":[{"rid":"a"},{"rid":"b"}],"entry":"WBIL"}`, `{"items":[{"rid":"c"}]}`,
+			`{"entry":"WBIL","items":[{"rid":"c"}]}`},
+		{"large numbers are kept exact", `{"sm_id":1}`, `{"sm_id":9007199254740993}`, `{"sm_id":9007199254740993}`},
+	}
+	decode := func(t *testing.T, data string) any {
+		t.Helper()
+		dec := json.NewDecoder(strings.NewReader(data))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(mergePatch(decode(t, tt.target), decode(t, tt.patch)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("mergePatch() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	db := &fakeStorage{getOrder: func(ctx context.Context, uuid string) (*storage.Order, error) {
+		return &storage.Order{OrderID: uuid, Version: 7}, nil
+	}}
+	o := newTestOrders(db, newFakeCache(), time.Second)
+
+	tests := []struct {
+		name    string
+		header  string
+		version int64
+		status  int
+	}{
+		{"strong ETag", `"3"`, 3, 0},
+		{"padded", `  "3" `, 3, 0},
+		{"unquoted", `3`, 3, 0},
+		{"any version", `*`, 7, 0},
+		{"list with current version", `"3", "7"`, 7, 0},
+		{"list without spaces", `"7","8"`, 7, 0},
+		{"list of stale versions", `"3", "4"`, 0, http.StatusPreconditionFailed},
+		{"weak ETag is skipped", `W/"7", "3"`, 3, 0},
+		{"missing", ``, 0, http.StatusPreconditionRequired},
+		{"weak ETag", `W/"3"`, 0, http.StatusPreconditionFailed},
+		{"not a version", `"abc"`, 0, http.StatusPreconditionFailed},
+		{"zero version", `"0"`, 0, http.StatusPreconditionFailed},
+		{"negative version", `"-1"`, 0, http.StatusPreconditionFailed},
+		{"empty list", `,`, 0, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/b563feb7b2b84b6test", nil)
+			if tt.header != "" {
+				r.Header.Set("If-Match", tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			version, ok := o.ifMatch(w, r, "b563feb7b2b84b6test")
+			if ok != (tt.status == 0) || version != tt.version {
+				t.Fatalf("ifMatch() = %d, %v, want %d", version, ok, tt.version)
+			}
+			if tt.status != 0 && w.Code != tt.status {
+				t.Fatalf("responded %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestPatchRejectsNonObject(t *testing.T) {
+	o := newTestOrders(&fakeStorage{}, newFakeCache(), time.Second)
+	router := o.Routes()
+
+	for _, patch := range []string{`[{"op":"replace"}]`, `"entry"`, `null`, `42`} {
+		r := httptest.NewRequest(http.MethodPatch, "/b563feb7b2b84b6test", strings.NewReader(patch))
+		r.Header.Set("If-Match", `"1"`)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("patch %s: responded %d, want 400", patch, w.Code)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package logger
+
+import (
+	"context"
+	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// New -- creates the logger with level and format from config. Attributes put into the context with With are added to every
+// record logged with that context, so use the *Context methods of the logger wherever the context is available.
+func New(cfg config.Log) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.EqualFold(cfg.Format, FormatText) {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// Err -- is the attribute of the error.
+func Err(err error) slog.Attr {
+	return slog.Any("err", err)
+}
+
+type ctxKey struct{}
+
+// With -- returns the copy of ctx carrying args in addition to the ones ctx already carries. args are the same key-value pairs
+// or slog.Attr as in slog.Logger.With.
+func With(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(ctxKey{}).([]slog.Attr)
+	record := slog.Record{}
+	record.Add(args...)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs[:len(attrs):len(attrs)], attr)
+		return true
+	})
+	return context.WithValue(ctx, ctxKey{}, attrs)
+}
+
+// contextHandler -- adds the attributes carried by the context to the record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(ctxKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "l0"
+
+// HTTP
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "http", Name: "requests_total",
+		Help: "HTTP requests by chi route pattern and status code.",
+	}, []string{"method", "route", "status"})
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "http", Name: "request_duration_seconds",
+		Help:    "HTTP request latency by chi route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+// Cache
+var (
+	CacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "cache", Name: "hits_total",
+		Help: "Orders found in cache.",
+	})
+	CacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "cache", Name: "misses_total",
+		Help: "Orders missing in cache.",
+	})
+	CacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "cache", Name: "evictions_total",
+		Help: "Orders evicted from cache.",
+	})
+	CacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "cache", Name: "size",
+		Help: "Orders in cache.",
+	})
+	CacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "cache", Name: "bytes",
+		Help: "Approximate size of cached orders.",
+	})
+	CachePendingBackup = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "cache", Name: "pending_backup",
+		Help: "Cached uuids in the backup set.",
+	})
+)
+
+// Retention
+var (
+	RetentionArchived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "retention", Name: "archived_total",
+		Help: "Orders archived and purged by the retention policy.",
+	})
+	RetentionRestored = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "retention", Name: "restored_total",
+		Help: "Archived orders brought back to the live tables.",
+	})
+)
+
+// Storage
+var (
+	StorageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "storage", Name: "operation_duration_seconds",
+		Help:    "Storage operation latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+	StorageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "storage", Name: "errors_total",
+		Help: "Failed storage operations by the stage of the order they failed on.",
+	}, []string{"operation", "stage"})
+)
+
+// Broker
+var (
+	BrokerPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "broker", Name: "published_total",
+		Help: "Messages published by subject.",
+	}, []string{"subject"})
+	BrokerConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "broker", Name: "consumed_total",
+		Help: "Messages received by subject.",
+	}, []string{"subject"})
+	BrokerFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "broker", Name: "failed_total",
+		Help: "Messages which couldn't be published or handled by subject.",
+	}, []string{"subject"})
+	BrokerIngested = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "broker", Name: "ingested_total",
+		Help: "Orders handled by Saver by outcome: saved, duplicate (redelivered and already saved), conflict or failed.",
+	}, []string{"outcome"})
+)
+
+// ObserveStorage -- records the latency of the storage operation started at start and counts its error by the failed stage.
+// Missing and already saved orders aren't counted as errors.
+func ObserveStorage(operation string, start time.Time, err error) {
+	StorageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err == nil || errors.Is(err, storage.ErrOrderNotFound) || errors.Is(err, storage.ErrDuplicateOrder) ||
+		errors.Is(err, storage.ErrSnapshotNotFound) || errors.Is(err, storage.ErrIllegalTransition) ||
+		errors.Is(err, storage.ErrVersionMismatch) {
+		return
+	}
+
+	stage := "other"
+	var opErr *storage.OpError
+	switch {
+	case errors.As(err, &opErr):
+		stage = opErr.Stage
+	case errors.Is(err, storage.ErrOrderConflict):
+		stage = "conflict"
+	}
+	StorageErrors.WithLabelValues(operation, stage).Inc()
+}
+
+// Middleware -- counts requests and observes their latency by chi route pattern. Must be used on the root router.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		HTTPDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,128 @@
+package nats_server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/nats-io/stan.go"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrDeadLetterNotFound -- there is no dead letter with such sequence.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter -- is published to the dead-letter subject for every SaveOrder message which couldn't be decoded or persisted.
+// Payload is the original message data, Sequence -- its sequence in the SaveOrder channel.
+type DeadLetter struct {
+	Subject   string    `json:"subject"`
+	Sequence  uint64    `json:"sequence"`
+	Payload   []byte    `json:"payload"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// DeadLetterEntry -- is the DeadLetter indexed by its sequence in the dead-letter channel. Replayed is set once the payload has been
+// published back to SaveOrder by the current process.
+type DeadLetterEntry struct {
+	Seq uint64 `json:"seq"`
+	DeadLetter
+	Replayed bool `json:"replayed"`
+}
+
+// deadLetters -- is the in-memory index of the dead-letter channel.
+type deadLetters struct {
+	mu      sync.RWMutex
+	entries map[uint64]*DeadLetterEntry
+}
+
+// deadLetter -- publishes the message payload to the dead-letter subject along with the error and the number of attempts made.
+func (b *Broker) deadLetter(ctx context.Context, m *stan.Msg, payload []byte, cause error, attempts int) error {
+	letter, err := json.Marshal(DeadLetter{
+		Subject:   m.Subject,
+		Sequence:  m.Sequence,
+		Payload:   payload,
+		Error:     cause.Error(),
+		Attempts:  attempts,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if letter, err = wrap(ctx, letter); err != nil {
+		return err
+	}
+	return b.publish(b.cfg.DeadLetter, letter)
+}
+
+// DeadLetterIndex -- reads the dead-letter channel from the beginning and keeps its entries in memory, so they can be listed, inspected
+// and replayed. The subscription is closed on Shutdown.
+func (b *Broker) DeadLetterIndex() (stan.Subscription, error) {
+	sub, err := b.sc.Subscribe(b.cfg.DeadLetter, func(m *stan.Msg) {
+		metrics.BrokerConsumed.WithLabelValues(m.Subject).Inc()
+		var letter DeadLetter
+		_, data := unwrap(context.Background(), m.Data)
+		if err := json.Unmarshal(data, &letter); err != nil {
+			b.log.Error("couldn't unmarshal dead letter", "subject", m.Subject, "seq", m.Sequence, logger.Err(err))
+			return
+		}
+
+		b.dlq.mu.Lock()
+		b.dlq.entries[m.Sequence] = &DeadLetterEntry{Seq: m.Sequence, DeadLetter: letter}
+		b.dlq.mu.Unlock()
+	}, stan.DeliverAllAvailable())
+	if err != nil {
+		b.log.Error("couldn't run dead-letter index", "subject", b.cfg.DeadLetter, logger.Err(err))
+		return nil, err
+	}
+	b.track(sub)
+	return sub, nil
+}
+
+// DeadLetters -- lists the indexed dead letters ordered by sequence.
+func (b *Broker) DeadLetters() []DeadLetterEntry {
+	b.dlq.mu.RLock()
+	defer b.dlq.mu.RUnlock()
+
+	entries := make([]DeadLetterEntry, 0, len(b.dlq.entries))
+	for _, entry := range b.dlq.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	return entries
+}
+
+// DeadLetter -- returns the dead letter with the given sequence in the dead-letter channel.
+func (b *Broker) DeadLetter(seq uint64) (DeadLetterEntry, error) {
+	b.dlq.mu.RLock()
+	defer b.dlq.mu.RUnlock()
+
+	entry, ok := b.dlq.entries[seq]
+	if !ok {
+		return DeadLetterEntry{}, ErrDeadLetterNotFound
+	}
+	return *entry, nil
+}
+
+// Replay -- publishes the payload of the dead letter back to SaveOrder. Must be used once the cause of the failure is fixed.
+func (b *Broker) Replay(ctx context.Context, seq uint64) error {
+	b.dlq.mu.Lock()
+	defer b.dlq.mu.Unlock()
+
+	entry, ok := b.dlq.entries[seq]
+	if !ok {
+		return ErrDeadLetterNotFound
+	}
+
+	if err := b.PublishOrder(ctx, entry.Payload); err != nil {
+		return err
+	}
+	entry.Replayed = true
+	return nil
+}
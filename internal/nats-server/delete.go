@@ -0,0 +1,80 @@
+package nats_server
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/stan.go"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/metrics"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+)
+
+const DeleteOrder = "deleteOrder"
+
+// Deleter -- deletes orders by the uuids got from streaming channel with the DeleteOrder message, removing them from cache along
+// with their backup. The subscription is durable and joins the queue group from config. Messages are acked once the order has been
+// deleted or turned out to be missing, the ones failed to be deleted are redelivered after AckWait.
+func (b *Broker) Deleter() (stan.Subscription, error) {
+	sub, err := b.sc.QueueSubscribe(DeleteOrder, b.cfg.QueueGroup, b.deleteOrder,
+		stan.DurableName(b.cfg.DeleteDurableName),
+		stan.DeliverAllAvailable(),
+		stan.SetManualAckMode(),
+		stan.AckWait(b.cfg.AckWait),
+		stan.MaxInflight(b.cfg.MaxInflight),
+	)
+	if err != nil {
+		b.log.Error("couldn't run channel", "subject", DeleteOrder, logger.Err(err))
+		return nil, err
+	}
+	b.track(sub)
+	return sub, nil
+}
+
+// deleteOrder -- handles a single DeleteOrder message, which data is the uuid of the order.
+func (b *Broker) deleteOrder(m *stan.Msg) {
+	if !b.begin() {
+		// not acked: the message is redelivered after restart
+		return
+	}
+	defer b.inflight.Done()
+	metrics.BrokerConsumed.WithLabelValues(m.Subject).Inc()
+
+	ctx, payload := unwrap(context.Background(), m.Data)
+	uuid := strings.TrimSpace(string(payload))
+	ctx, span := tracer.Start(ctx, m.Subject+" process", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", m.Subject),
+			attribute.Int64("messaging.message.sequence", int64(m.Sequence)),
+			attribute.String("order_uid", uuid),
+		))
+	defer span.End()
+	ctx = logger.With(ctx, "subject", m.Subject, "seq", m.Sequence, "order_uid", uuid)
+
+	if uuid == "" {
+		metrics.BrokerFailed.WithLabelValues(m.Subject).Inc()
+		b.log.ErrorContext(ctx, "delete request has no order uuid, skipping")
+		b.ack(ctx, m)
+		return
+	}
+
+	err := (*b.db).Delete(ctx, uuid)
+	switch {
+	case errors.Is(err, storage.ErrOrderNotFound):
+		b.log.InfoContext(ctx, "order has already been deleted, skipping")
+	case err != nil:
+		metrics.BrokerFailed.WithLabelValues(m.Subject).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		// not acked: the message is redelivered after AckWait
+		b.log.ErrorContext(ctx, "couldn't delete order", logger.Err(err))
+		return
+	default:
+		b.log.DebugContext(ctx, "order deleted")
+	}
+	b.cache.Delete(uuid)
+	b.ack(ctx, m)
+}
@@ -0,0 +1,44 @@
+package nats_server
+
+import (
+	"context"
+	"encoding/json"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Envelope -- wraps the data published to a streaming channel along with the trace context, as streaming messages have no headers.
+// Attempts is the number of attempts made to handle the data before it has been republished to be retried.
+type Envelope struct {
+	Headers  map[string]string `json:"headers,omitempty"`
+	Data     []byte            `json:"data"`
+	Attempts int               `json:"attempts,omitempty"`
+}
+
+// wrap -- puts data into Envelope carrying the trace context of ctx.
+func wrap(ctx context.Context, data []byte) ([]byte, error) {
+	return wrapRetry(ctx, data, 0)
+}
+
+// wrapRetry -- puts data into Envelope carrying the trace context of ctx and the number of attempts already made.
+func wrapRetry(ctx context.Context, data []byte, attempts int) ([]byte, error) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return json.Marshal(Envelope{Headers: carrier, Data: data, Attempts: attempts})
+}
+
+// unwrap -- takes data out of Envelope and returns ctx continuing the trace it carries. Messages published without Envelope are
+// returned as they are.
+func unwrap(ctx context.Context, msg []byte) (context.Context, []byte) {
+	ctx, envelope := unwrapEnvelope(ctx, msg)
+	return ctx, envelope.Data
+}
+
+// unwrapEnvelope -- is unwrap returning the whole Envelope. Messages published without Envelope are returned as its Data.
+func unwrapEnvelope(ctx context.Context, msg []byte) (context.Context, Envelope) {
+	var envelope Envelope
+	if err := json.Unmarshal(msg, &envelope); err != nil || envelope.Data == nil {
+		return ctx, Envelope{Data: msg}
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(envelope.Headers)), envelope
+}
@@ -1,39 +1,170 @@
 package nats_server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/stan.go"
-	"github.com/wlcmtunknwndth/L0_WB/internal/cacher"
 	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/metrics"
 	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
-	"net/http"
+	"math"
+	"sync"
+	"time"
 )
 
 type Storage interface {
-	SaveOrder(order *storage.Order) error
-	GetOrder(uuid string) (*storage.Order, error)
+	SaveOrder(ctx context.Context, order *storage.Order) error
+	GetOrder(ctx context.Context, uuid string) (*storage.Order, error)
+	Delete(ctx context.Context, uuid string) error
+}
+
+// Cache -- is notified about the outcome of the orders consumed by Saver and the orders deleted by Deleter.
+type Cache interface {
+	OrderSaved(order storage.Order)
+	OrderFailed(uuid string)
+	Delete(uuid string)
 }
 
 type Broker struct {
-	sc stan.Conn
-	db *Storage
+	log   *slog.Logger
+	sc    stan.Conn
+	db    *Storage
+	cache Cache
+	cfg   config.Nats
+	dlq   deadLetters
+
+	// subscriptions opened by the broker, closed by Shutdown
+	mu       sync.Mutex
+	subs     []stan.Subscription
+	natsSubs []*nats.Subscription
+	// inflight -- are the messages being handled and the failed orders waiting to be republished in retries. Both are started
+	// under mu unless closing is set by Shutdown, so no work is started once Shutdown waits for inflight.
+	inflight sync.WaitGroup
+	retries  map[*time.Timer]struct{}
+	closing  bool
 }
 
-// New -- creates a new instance of our Broker, which is needed stan.Conn and storage with methods SaveOrder(order *storage.Order) error and
-// GetOrder(uuid string) (*storage.Order, error).
-func New(cfg *config.Config, db Storage) *Broker {
+// New -- creates a new instance of our Broker, which is needed stan.Conn and storage with methods SaveOrder(ctx context.Context, order *storage.Order) error,
+// GetOrder(ctx context.Context, uuid string) (*storage.Order, error) and Delete(ctx context.Context, uuid string) error. Returns the
+// error if NATS Streaming can't be connected.
+func New(cfg *config.Config, db Storage, cache Cache, log *slog.Logger) (*Broker, error) {
+	const op = "nats-server.New"
+	if cfg.Nats.RetryBackoffMax >= cfg.Nats.AckWait || cfg.Nats.RetryFactor < 1 {
+		return nil, fmt.Errorf("%s: %w", op, ErrRetryBackoff)
+	}
+
 	sc, err := stan.Connect(
-		"test-cluster",
-		"db-saver",
+		cfg.Nats.ClusterID,
+		cfg.Nats.ClientID,
 		stan.Pings(1, 3),
 		stan.NatsURL(cfg.Nats.IpAddr),
 	)
 	if err != nil {
-		slog.Error("couldn't run nats server")
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &Broker{
+		log:     log.With("component", "broker"),
+		db:      &db,
+		cache:   cache,
+		sc:      sc,
+		cfg:     cfg.Nats,
+		dlq:     deadLetters{entries: make(map[uint64]*DeadLetterEntry)},
+		retries: make(map[*time.Timer]struct{}),
+	}, nil
+}
+
+var tracer = otel.Tracer("nats-server")
+
+var (
+	// ErrNotConnected -- the broker has no connection to NATS Streaming.
+	ErrNotConnected = errors.New("not connected to nats streaming")
+	// ErrRetryBackoff -- the retry backoff doesn't grow or isn't less than AckWait, so the failed order would be redelivered
+	// before it is republished.
+	ErrRetryBackoff = errors.New("retry backoff must be less than ack wait and retry factor at least 1")
+)
+
+// Ping -- returns ErrNotConnected unless the underlying NATS connection is established. Is used as the readiness check.
+func (b *Broker) Ping(ctx context.Context) error {
+	if status := b.sc.NatsConn().Status(); status != nats.CONNECTED {
+		return fmt.Errorf("%w: %s", ErrNotConnected, status)
 	}
+	return nil
+}
+
+// begin -- counts the message as being handled, unless Shutdown has been started. The message must not be handled if it returns
+// false.
+func (b *Broker) begin() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closing {
+		return false
+	}
+	b.inflight.Add(1)
+	return true
+}
 
-	return &Broker{db: &db, sc: sc}
+// track -- remembers the subscription to close it on Shutdown.
+func (b *Broker) track(sub stan.Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, sub)
+}
+
+// Shutdown -- stops handling new messages, closes the subscriptions opened by the broker, waits until ctx is done for the ones
+// being handled and closes the connection. Durable subscriptions are closed, not unsubscribed, so the restarted service continues
+// from the last acked message.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	b.closing = true
+	subs, natsSubs := b.subs, b.natsSubs
+	b.subs, b.natsSubs = nil, nil
+	// the orders waiting to be retried are left unacked, so they are redelivered after restart
+	for timer := range b.retries {
+		if timer.Stop() {
+			b.inflight.Done()
+		}
+	}
+	clear(b.retries)
+	b.mu.Unlock()
+
+	var errs []error
+	for _, sub := range natsSubs {
+		if err := sub.Drain(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, sub := range subs {
+		if err := sub.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("waiting for in-flight orders: %w", ctx.Err()))
+	}
+
+	if err := b.sc.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
 }
 
 const (
@@ -41,102 +172,307 @@ const (
 	SaveOrder = "saveOrder"
 )
 
-// Saver -- saves orders got from streaming channel with the SaveMessage message.
+// Saver -- saves orders got from streaming channel with the SaveOrder message. The subscription is durable and joins the queue group
+// from config, so the restarted service continues from the last acked message. Messages are acked manually: only after the order
+// has been committed or sent to the dead-letter subject.
 func (b *Broker) Saver() (stan.Subscription, error) {
-	sub, err := b.sc.Subscribe(SaveOrder, func(m *stan.Msg) {
-		var order storage.Order
-		err := json.Unmarshal(m.Data, &order)
-		if err != nil {
-			slog.Error("couldn't unmarshal order: ", err)
-			return
+	sub, err := b.sc.QueueSubscribe(SaveOrder, b.cfg.QueueGroup, b.saveOrder,
+		stan.DurableName(b.cfg.DurableName),
+		stan.DeliverAllAvailable(),
+		stan.SetManualAckMode(),
+		stan.AckWait(b.cfg.AckWait),
+		stan.MaxInflight(b.cfg.MaxInflight),
+	)
+	if err != nil {
+		b.log.Error("couldn't run channel", "subject", SaveOrder, logger.Err(err))
+		return nil, err
+	}
+	b.track(sub)
+	return sub, nil
+}
+
+// saveOrder -- handles a single SaveOrder message. Orders failed to be saved are republished after the backoff growing with every
+// attempt, up to MaxRetries attempts in total. The attempts are counted by the republished Envelope along with the redeliveries of
+// the message, as it is left unacked if the process stops before the order is republished.
+// Orders which couldn't be decoded, haven't passed validation, conflict with the saved ones or run out of attempts are sent to
+// the dead-letter subject. The trace started by the publisher is continued from the message's Envelope.
+func (b *Broker) saveOrder(m *stan.Msg) {
+	if !b.begin() {
+		// not acked: the message is redelivered after restart
+		return
+	}
+	defer b.inflight.Done()
+	metrics.BrokerConsumed.WithLabelValues(m.Subject).Inc()
+
+	ctx, envelope := unwrapEnvelope(context.Background(), m.Data)
+	payload := envelope.Data
+	attempts := envelope.Attempts + int(m.RedeliveryCount) + 1
+	ctx, span := tracer.Start(ctx, m.Subject+" process", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", m.Subject),
+			attribute.Int64("messaging.message.sequence", int64(m.Sequence)),
+			attribute.Bool("messaging.message.redelivered", m.Redelivered),
+			attribute.Int("messaging.message.attempt", attempts),
+		))
+	defer span.End()
+	ctx = logger.With(ctx, "subject", m.Subject, "seq", m.Sequence)
+
+	var order storage.Order
+	fail := func(err error, attempts int) {
+		metrics.BrokerFailed.WithLabelValues(m.Subject).Inc()
+		if order.OrderID != "" {
+			b.cache.OrderFailed(order.OrderID)
 		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		b.deadLetterAndAck(ctx, m, payload, err, attempts)
+	}
+
+	if err := json.Unmarshal(payload, &order); err != nil {
+		metrics.BrokerIngested.WithLabelValues("failed").Inc()
+		b.log.ErrorContext(ctx, "couldn't unmarshal order", logger.Err(err))
+		fail(err, attempts)
+		return
+	}
+	span.SetAttributes(attribute.String("order_uid", order.OrderID))
+	ctx = logger.With(ctx, "order_uid", order.OrderID)
+	if err := order.Validate(); err != nil {
+		metrics.BrokerIngested.WithLabelValues("failed").Inc()
+		b.log.ErrorContext(ctx, "invalid order", logger.Err(err))
+		fail(err, attempts)
+		return
+	}
+	order.Status, order.Version = storage.StatusCreated, storage.FirstVersion
+
+	// the attempt must end before the message is redelivered
+	saveCtx, cancel := context.WithTimeout(ctx, b.cfg.AckWait)
+	err := (*b.db).SaveOrder(saveCtx, &order)
+	cancel()
+	if err != nil && !errors.Is(err, storage.ErrDuplicateOrder) && !errors.Is(err, storage.ErrOrderConflict) &&
+		attempts < b.cfg.MaxRetries {
+		delay := b.backoff(attempts)
+		b.log.WarnContext(ctx, "couldn't save order, retrying", "attempt", attempts, "backoff", delay, logger.Err(err))
+		b.retry(ctx, m, payload, attempts, delay)
+		return
+	}
+
+	switch {
+	case errors.Is(err, storage.ErrDuplicateOrder):
+		metrics.BrokerIngested.WithLabelValues("duplicate").Inc()
+		b.log.InfoContext(ctx, "order has already been saved, skipping")
+		// the saved order may have been updated since, so it is read from storage on the next request
+		b.cache.Delete(order.OrderID)
+	case errors.Is(err, storage.ErrOrderConflict):
+		metrics.BrokerIngested.WithLabelValues("conflict").Inc()
+		b.log.ErrorContext(ctx, "order conflicts with the saved one", logger.Err(err))
+		fail(err, attempts)
+		return
+	case err != nil:
+		metrics.BrokerIngested.WithLabelValues("failed").Inc()
+		b.log.ErrorContext(ctx, "couldn't save order", "attempts", attempts, logger.Err(err))
+		fail(err, attempts)
+		return
+	default:
+		metrics.BrokerIngested.WithLabelValues("saved").Inc()
+		b.log.DebugContext(ctx, "order saved")
+		b.cache.OrderSaved(order)
+	}
+	b.ack(ctx, m)
+}
+
+// backoff -- returns the delay before the next attempt after the given number of attempts made.
+func (b *Broker) backoff(attempts int) time.Duration {
+	delay := float64(b.cfg.RetryBackoff) * math.Pow(b.cfg.RetryFactor, float64(attempts-1))
+	if delay > float64(b.cfg.RetryBackoffMax) {
+		return b.cfg.RetryBackoffMax
+	}
+	return time.Duration(delay)
+}
+
+// retry -- republishes the payload of the message to SaveOrder after delay, counting the attempts made, and acks the message. If
+// it couldn't be republished, the message is left unacked to be redelivered.
+func (b *Broker) retry(ctx context.Context, m *stan.Msg, payload []byte, attempts int, delay time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closing {
+		// not acked: the message is redelivered after restart
+		return
+	}
 
-		err = (*b.db).SaveOrder(&order) // fix
+	b.inflight.Add(1)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		defer b.inflight.Done()
+		b.mu.Lock()
+		delete(b.retries, timer)
+		b.mu.Unlock()
+
+		data, err := wrapRetry(ctx, payload, attempts)
+		if err == nil {
+			err = b.publish(SaveOrder, data)
+		}
 		if err != nil {
-			slog.Error("couldn't save order: ", err)
+			b.log.ErrorContext(ctx, "couldn't republish order to retry", logger.Err(err))
 			return
 		}
+		b.ack(ctx, m)
 	})
-	if err != nil {
-		slog.Error("couldn't run channel: ", err)
-		return nil, err
+	b.retries[timer] = struct{}{}
+}
+
+// deadLetterAndAck -- sends the payload of the message to the dead-letter subject and acks it. If the dead letter couldn't be
+// published, the message is left unacked to be redelivered.
+func (b *Broker) deadLetterAndAck(ctx context.Context, m *stan.Msg, payload []byte, cause error, attempts int) {
+	if err := b.deadLetter(ctx, m, payload, cause, attempts); err != nil {
+		b.log.ErrorContext(ctx, "couldn't publish dead letter", logger.Err(err))
+		return
+	}
+	b.ack(ctx, m)
+}
+
+// ackMsg -- acknowledges the message, is replaced by tests, as stan.Msg can be acked by its subscription only.
+var ackMsg = (*stan.Msg).Ack
+
+// ack -- acknowledges the message in manual ack mode.
+func (b *Broker) ack(ctx context.Context, m *stan.Msg) {
+	if err := ackMsg(m); err != nil {
+		b.log.ErrorContext(ctx, "couldn't ack message", logger.Err(err))
 	}
-	return sub, nil
 }
 
-// PublishOrder -- publishes order in []byte form with the SaveOrder message, which is listened by Saver.
-func (b *Broker) PublishOrder(order []byte) error {
-	err := b.sc.Publish(SaveOrder, order)
+// PublishEvent -- publishes the order status transition to cfg.StatusEvents subject, wrapped into Envelope carrying the trace
+// context of ctx.
+func (b *Broker) PublishEvent(ctx context.Context, event storage.OrderEvent) error {
+	subject := b.cfg.StatusEvents
+	ctx, span := tracer.Start(ctx, subject+" publish", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", subject), attribute.String("order_uid", event.OrderID)))
+	defer span.End()
+
+	data, err := json.Marshal(event)
+	if err == nil {
+		data, err = wrap(ctx, data)
+	}
+	if err == nil {
+		err = b.publish(subject, data)
+	}
 	if err != nil {
-		slog.Error("couldn't publish order to save: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		b.log.ErrorContext(ctx, "couldn't publish status event", "subject", subject, logger.Err(err))
 		return err
 	}
 	return nil
 }
 
-// PublishUUID -- publishes uuid(must be string) in []byte form to the streaming channel with the SendOrder message, so the GetHandler gets the uuid it must
-// look for in storage and send back.
-func (b *Broker) PublishUUID(uuid []byte) error {
-	err := b.sc.Publish(SendOrder, uuid)
+// PublishOrder -- publishes order in []byte form with the SaveOrder message, which is listened by Saver. The order is wrapped into
+// Envelope carrying the trace context of ctx.
+func (b *Broker) PublishOrder(ctx context.Context, order []byte) error {
+	ctx, span := tracer.Start(ctx, SaveOrder+" publish", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", SaveOrder)))
+	defer span.End()
+
+	msg, err := wrap(ctx, order)
+	if err == nil {
+		err = b.publish(SaveOrder, msg)
+	}
 	if err != nil {
-		slog.Error("couldn't publish order to save: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		b.log.ErrorContext(ctx, "couldn't publish order to save", "subject", SaveOrder, logger.Err(err))
+		return err
+	}
+	return nil
+}
+
+// publish -- publishes data to the streaming channel and counts it.
+func (b *Broker) publish(subject string, data []byte) error {
+	if err := b.sc.Publish(subject, data); err != nil {
+		metrics.BrokerFailed.WithLabelValues(subject).Inc()
 		return err
 	}
+	metrics.BrokerPublished.WithLabelValues(subject).Inc()
 	return nil
 }
 
-// GetHandler -- opens subscription to get request. When message is sent, gets the storage.Order from storage.Storage instance with chosen uuid and sends
-// it back to streaming channel with uuid of the instance as message, so the other subscription must wait for the message with uuid the user sent.
-func (b *Broker) GetHandler() (stan.Subscription, error) {
-	sub, err := b.sc.Subscribe(SendOrder, func(m *stan.Msg) {
+// OrderReply -- is the reply GetHandler sends to the RequestOrder inbox. Order is nil if it couldn't be found, the reason is in Error.
+type OrderReply struct {
+	Order    *storage.Order `json:"order,omitempty"`
+	NotFound bool           `json:"not_found,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// GetHandler -- answers the order requests sent by RequestOrder. The request data is the uuid of the order, the answer -- OrderReply
+// sent to the request's reply inbox. Uses core NATS, as streaming channels have no request/reply.
+func (b *Broker) GetHandler() (*nats.Subscription, error) {
+	sub, err := b.sc.NatsConn().Subscribe(SendOrder, func(m *nats.Msg) {
+		metrics.BrokerConsumed.WithLabelValues(m.Subject).Inc()
 		var uuid = string(m.Data)
+		var reply OrderReply
 
-		order, err := (*b.db).GetOrder(uuid)
-		if err != nil {
-			slog.Error("couldn't get order from storage: ", err)
-			return
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(m.Header))
+		ctx, span := tracer.Start(ctx, m.Subject+" process", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("order_uid", uuid)))
+		defer span.End()
+		ctx = logger.With(ctx, "subject", m.Subject, "order_uid", uuid)
+
+		order, err := (*b.db).GetOrder(ctx, uuid)
+		switch {
+		case errors.Is(err, storage.ErrOrderNotFound):
+			reply.NotFound = true
+		case err != nil:
+			b.log.ErrorContext(ctx, "couldn't get order from storage", logger.Err(err))
+			reply.Error = err.Error()
+		default:
+			reply.Order = order
 		}
 
-		ans, err := json.Marshal(order)
+		ans, err := json.Marshal(reply)
 		if err != nil {
-			slog.Error("couldn't encode order: ", err)
+			b.log.ErrorContext(ctx, "couldn't encode order", logger.Err(err))
 			return
 		}
 
-		if err = b.sc.Publish(order.OrderID, ans); err != nil {
-			slog.Error("couldn't publish order: ", err)
+		if err = m.Respond(ans); err != nil {
+			metrics.BrokerFailed.WithLabelValues(m.Subject).Inc()
+			b.log.ErrorContext(ctx, "couldn't respond with order", logger.Err(err))
 			return
 		}
 	})
 	if err != nil {
-		slog.Error("couldn't run get handler")
+		b.log.Error("couldn't run get handler", "subject", SendOrder, logger.Err(err))
 		return nil, err
 	}
+
+	b.mu.Lock()
+	b.natsSubs = append(b.natsSubs, sub)
+	b.mu.Unlock()
 	return sub, nil
 }
 
-// OrderGetter -- gets order from GetHandler and writes it to our http.ResponseWriter. It func opens subscription by uuid as the name
-// and waits for order sent back by GetHandler in []byte, then unmarshals it and write to user response body. Channel are used to verify if data has been sent,
-// otherwise the response won't be sent. Returns stan.Subscription to close it later in router(handler).
-func (b *Broker) OrderGetter(uuid string, w http.ResponseWriter, ch *chan bool, c *cacher.Cacher) (stan.Subscription, error) {
-	sub, err := b.sc.Subscribe(uuid, func(m *stan.Msg) {
-		var order storage.Order
-		if err := json.Unmarshal(m.Data, &order); err != nil {
-			slog.Error("couldn't unmarshal message: ", err)
-			return
-		}
-		c.CacheOrder(order)
+// RequestOrder -- requests the order by uuid from GetHandler and waits for the reply until ctx is done. Returns
+// storage.ErrOrderNotFound if there is no such order.
+func (b *Broker) RequestOrder(ctx context.Context, uuid string) (*storage.Order, error) {
+	const op = "nats-server.RequestOrder"
 
-		if _, err := w.Write(m.Data); err != nil {
-			slog.Error("couldn't write respond")
-			return
-		}
-		*ch <- true
-	})
+	req := nats.NewMsg(SendOrder)
+	req.Data = []byte(uuid)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	msg, err := b.sc.NatsConn().RequestMsgWithContext(ctx, req)
 	if err != nil {
-		slog.Error("couldn't run order getter: ", err)
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return sub, nil
+	var reply OrderReply
+	if err = json.Unmarshal(msg.Data, &reply); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	switch {
+	case reply.NotFound:
+		return nil, fmt.Errorf("%s: %s: %w", op, uuid, storage.ErrOrderNotFound)
+	case reply.Error != "":
+		return nil, fmt.Errorf("%s: %s", op, reply.Error)
+	}
+	return reply.Order, nil
 }
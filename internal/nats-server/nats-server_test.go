@@ -0,0 +1,285 @@
+package nats_server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// published -- is the message published to the fake connection.
+type published struct {
+	subject string
+	data    []byte
+}
+
+// fakeConn -- stan.Conn recording the published messages, the rest of its methods panic.
+type fakeConn struct {
+	stan.Conn
+	mu        sync.Mutex
+	published []published
+}
+
+func (c *fakeConn) Publish(subject string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, published{subject: subject, data: data})
+	return nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+// take -- waits for the next published message and removes it.
+func (c *fakeConn) take(t *testing.T) published {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		if len(c.published) != 0 {
+			msg := c.published[0]
+			c.published = c.published[1:]
+			c.mu.Unlock()
+			return msg
+		}
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("nothing has been published")
+	return published{}
+}
+
+// fakeStorage -- Storage failing every SaveOrder and Delete with err.
+type fakeStorage struct {
+	err   error
+	saves int
+}
+
+func (s *fakeStorage) SaveOrder(ctx context.Context, order *storage.Order) error {
+	s.saves++
+	return s.err
+}
+
+func (s *fakeStorage) GetOrder(ctx context.Context, uuid string) (*storage.Order, error) {
+	return nil, storage.ErrOrderNotFound
+}
+
+func (s *fakeStorage) Delete(ctx context.Context, uuid string) error {
+	return s.err
+}
+
+// fakeCache -- Cache recording the deleted uuids.
+type fakeCache struct {
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (c *fakeCache) OrderSaved(order storage.Order) {}
+func (c *fakeCache) OrderFailed(uuid string)        {}
+
+func (c *fakeCache) Delete(uuid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deleted = append(c.deleted, uuid)
+}
+
+// acks -- replaces ackMsg for the test and counts the acked messages by sequence.
+type acks struct {
+	mu   sync.Mutex
+	seqs map[uint64]int
+}
+
+func trackAcks(t *testing.T) *acks {
+	a := &acks{seqs: make(map[uint64]int)}
+	prev := ackMsg
+	ackMsg = func(m *stan.Msg) error {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.seqs[m.Sequence]++
+		return nil
+	}
+	t.Cleanup(func() { ackMsg = prev })
+	return a
+}
+
+func (a *acks) count(seq uint64) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seqs[seq]
+}
+
+var testNats = config.Nats{
+	DeadLetter:      "saveOrder.dlq",
+	AckWait:         time.Second,
+	MaxRetries:      3,
+	RetryBackoff:    time.Millisecond,
+	RetryFactor:     2,
+	RetryBackoffMax: 3 * time.Millisecond,
+}
+
+func newTestBroker(db Storage, cache Cache) (*Broker, *fakeConn) {
+	conn := &fakeConn{}
+	return &Broker{
+		log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		sc:      conn,
+		db:      &db,
+		cache:   cache,
+		cfg:     testNats,
+		dlq:     deadLetters{entries: make(map[uint64]*DeadLetterEntry)},
+		retries: make(map[*time.Timer]struct{}),
+	}, conn
+}
+
+func newMsg(seq uint64, subject string, data []byte, redeliveries uint32) *stan.Msg {
+	return &stan.Msg{MsgProto: pb.MsgProto{Sequence: seq, Subject: subject, Data: data, RedeliveryCount: redeliveries,
+		Redelivered: redeliveries != 0}}
+}
+
+func TestSaveOrderRetriesUntilDeadLetter(t *testing.T) {
+	acked := trackAcks(t)
+	db := &fakeStorage{err: errors.New("db is down")}
+	b, conn := newTestBroker(db, &fakeCache{})
+
+	order, _ := json.Marshal(storage.RandomOrder("b563feb7b2b84b6test"))
+	data, _ := wrap(context.Background(), order)
+	for seq := uint64(1); seq < uint64(testNats.MaxRetries); seq++ {
+		b.saveOrder(newMsg(seq, SaveOrder, data, 0))
+
+		msg := conn.take(t)
+		if msg.subject != SaveOrder {
+			t.Fatalf("attempt %d is published to %s, want it republished to %s", seq, msg.subject, SaveOrder)
+		}
+		_, envelope := unwrapEnvelope(context.Background(), msg.data)
+		if envelope.Attempts != int(seq) || string(envelope.Data) != string(order) {
+			t.Fatalf("republished attempts = %d, want %d", envelope.Attempts, seq)
+		}
+		b.inflight.Wait()
+		if acked.count(seq) != 1 {
+			t.Fatalf("message %d isn't acked once republished", seq)
+		}
+		data = msg.data
+	}
+
+	last := uint64(testNats.MaxRetries)
+	b.saveOrder(newMsg(last, SaveOrder, data, 0))
+	msg := conn.take(t)
+	if msg.subject != testNats.DeadLetter {
+		t.Fatalf("the last attempt is published to %s, want %s", msg.subject, testNats.DeadLetter)
+	}
+	var letter DeadLetter
+	_, payload := unwrap(context.Background(), msg.data)
+	if err := json.Unmarshal(payload, &letter); err != nil {
+		t.Fatal(err)
+	}
+	if letter.Attempts != testNats.MaxRetries || string(letter.Payload) != string(order) {
+		t.Fatalf("dead letter has %d attempts, want %d", letter.Attempts, testNats.MaxRetries)
+	}
+	if acked.count(last) != 1 || db.saves != testNats.MaxRetries {
+		t.Fatalf("acked %d times after %d saves", acked.count(last), db.saves)
+	}
+}
+
+func TestSaveOrderCountsRedeliveries(t *testing.T) {
+	acked := trackAcks(t)
+	b, conn := newTestBroker(&fakeStorage{err: errors.New("db is down")}, &fakeCache{})
+
+	order, _ := json.Marshal(storage.RandomOrder("b563feb7b2b84b6test"))
+	// republished once and then redelivered, as the process has stopped before acking it
+	data, _ := wrapRetry(context.Background(), order, 1)
+	b.saveOrder(newMsg(7, SaveOrder, data, 1))
+
+	if msg := conn.take(t); msg.subject != testNats.DeadLetter {
+		t.Fatalf("published to %s, want %s", msg.subject, testNats.DeadLetter)
+	}
+	if acked.count(7) != 1 {
+		t.Fatal("dead-lettered message isn't acked")
+	}
+}
+
+func TestSaveOrderShutdownLeavesRetryUnacked(t *testing.T) {
+	acked := trackAcks(t)
+	b, conn := newTestBroker(&fakeStorage{err: errors.New("db is down")}, &fakeCache{})
+	b.cfg.RetryBackoff, b.cfg.RetryBackoffMax = time.Hour, time.Hour
+
+	order, _ := json.Marshal(storage.RandomOrder("b563feb7b2b84b6test"))
+	b.saveOrder(newMsg(1, SaveOrder, order, 0))
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if acked.count(1) != 0 || len(conn.published) != 0 {
+		t.Fatal("order waiting to be retried is acked or published on shutdown")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := &Broker{cfg: config.Nats{RetryBackoff: time.Second, RetryFactor: 2, RetryBackoffMax: 5 * time.Second}}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, delay := range want {
+		if got := b.backoff(i + 1); got != delay {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, delay)
+		}
+	}
+}
+
+func TestNewRejectsBackoffOverAckWait(t *testing.T) {
+	cfg := &config.Config{Nats: testNats}
+	cfg.Nats.RetryBackoffMax = cfg.Nats.AckWait
+	if _, err := New(cfg, &fakeStorage{}, &fakeCache{}, slog.New(slog.NewTextHandler(io.Discard, nil))); !errors.Is(err, ErrRetryBackoff) {
+		t.Fatalf("New() = %v, want ErrRetryBackoff", err)
+	}
+}
+
+func TestShutdownRefusesNewMessages(t *testing.T) {
+	acked := trackAcks(t)
+	db := &fakeStorage{}
+	b, _ := newTestBroker(db, &fakeCache{})
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	order, _ := json.Marshal(storage.RandomOrder("b563feb7b2b84b6test"))
+	b.saveOrder(newMsg(1, SaveOrder, order, 0))
+	b.deleteOrder(newMsg(2, DeleteOrder, []byte("b563feb7b2b84b6test"), 0))
+	if db.saves != 0 || acked.count(1) != 0 || acked.count(2) != 0 {
+		t.Fatal("message is handled after shutdown")
+	}
+}
+
+func TestDeleteOrderInvalidatesCache(t *testing.T) {
+	const uuid = "b563feb7b2b84b6test"
+	tests := []struct {
+		name        string
+		err         error
+		invalidated bool
+	}{
+		{"deleted", nil, true},
+		{"already deleted", storage.ErrOrderNotFound, true},
+		{"failed", errors.New("db is down"), false},
+	}
+	for seq, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acked := trackAcks(t)
+			cache := &fakeCache{}
+			b, _ := newTestBroker(&fakeStorage{err: tt.err}, cache)
+
+			data, _ := wrap(context.Background(), []byte(uuid))
+			b.deleteOrder(newMsg(uint64(seq), DeleteOrder, data, 0))
+
+			invalidated := len(cache.deleted) == 1 && cache.deleted[0] == uuid
+			if invalidated != tt.invalidated {
+				t.Fatalf("cache invalidated = %v, want %v", invalidated, tt.invalidated)
+			}
+			// failed deletes are redelivered, so the message is acked only along with the invalidation
+			if ack := acked.count(uint64(seq)) == 1; ack != tt.invalidated {
+				t.Fatalf("acked = %v, want %v", ack, tt.invalidated)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package retention
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	archivePrefix = "orders-"
+	archiveSuffix = ".ndjson.gz"
+	// maxArchiveLine -- is the maximum size of an archived order in NDJSON.
+	maxArchiveLine = 16 << 20
+)
+
+// fileArchive -- writes every archived batch to its own gzipped NDJSON file in dir, one storage.ArchivedOrder per line. Files are
+// named by the time of archiving, so they sort chronologically.
+type fileArchive struct {
+	dir string
+}
+
+// export -- writes the batch to a temporary file renamed into dir once synced, so the orders are purged only if the file is complete.
+func (f *fileArchive) export(_ context.Context, orders []storage.ArchivedOrder) (err error) {
+	const op = "retention.fileArchive.export"
+
+	if err = os.MkdirAll(f.dir, 0o755); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	tmp, err := os.CreateTemp(f.dir, ".orders-*.tmp")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	gz := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(gz)
+	for i := range orders {
+		if err = enc.Encode(&orders[i]); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err = gz.Close(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tmp.Sync(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	name := archivePrefix + time.Now().UTC().Format("20060102T150405.000000000") + archiveSuffix
+	if err = os.Rename(tmp.Name(), filepath.Join(f.dir, name)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// find -- looks the order up in the archive files, the latest archived copy wins. Returns storage.ErrOrderNotFound if no file has it.
+func (f *fileArchive) find(uuid string) (*storage.ArchivedOrder, error) {
+	const op = "retention.fileArchive.find"
+
+	entries, err := os.ReadDir(f.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %s: %w", op, uuid, storage.ErrOrderNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if name := entry.Name(); !entry.IsDir() && strings.HasPrefix(name, archivePrefix) && strings.HasSuffix(name, archiveSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for _, name := range names {
+		archived, err := findInFile(filepath.Join(f.dir, name), uuid)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", op, name, err)
+		}
+		if archived != nil {
+			return archived, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %s: %w", op, uuid, storage.ErrOrderNotFound)
+}
+
+// findInFile -- returns the order from the archive file, nil if the file doesn't have it.
+func findInFile(path, uuid string) (*storage.ArchivedOrder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	// only the matching line is decoded completely
+	var probe struct {
+		Order struct {
+			OrderID string `json:"order_uid"`
+		} `json:"order"`
+	}
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxArchiveLine)
+	for scanner.Scan() {
+		if err = json.Unmarshal(scanner.Bytes(), &probe); err != nil {
+			return nil, err
+		}
+		if probe.Order.OrderID != uuid {
+			continue
+		}
+		var archived storage.ArchivedOrder
+		if err = json.Unmarshal(scanner.Bytes(), &archived); err != nil {
+			return nil, err
+		}
+		return &archived, nil
+	}
+	return nil, scanner.Err()
+}
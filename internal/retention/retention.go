@@ -0,0 +1,152 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/metrics"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"log/slog"
+	"time"
+)
+
+type Storage interface {
+	ArchiveOrders(ctx context.Context, before time.Time, limit int,
+		export func(ctx context.Context, orders []storage.ArchivedOrder) error) ([]string, error)
+	RestoreArchived(ctx context.Context, uuid string) (*storage.Order, error)
+	RestoreOrder(ctx context.Context, archived *storage.ArchivedOrder) error
+}
+
+// Cache -- drops the copies of the archived orders.
+type Cache interface {
+	Delete(uuid string)
+}
+
+// ErrUnknownArchive -- the configured archive isn't supported.
+var ErrUnknownArchive = errors.New("unknown retention archive")
+
+// Job -- archives and purges the orders older than the retention period.
+type Job struct {
+	db    Storage
+	cache Cache
+	log   *slog.Logger
+	cfg   config.Retention
+	// files -- is nil unless orders are archived to files.
+	files *fileArchive
+}
+
+// New -- creates new instance of Job. cache may be nil if no cache has to be kept consistent, e.g. in the archive subcommand.
+func New(db Storage, cache Cache, cfg config.Retention, log *slog.Logger) (*Job, error) {
+	const op = "retention.New"
+
+	if cfg.Days < 0 || cfg.Batch < 1 || cfg.Interval <= 0 {
+		return nil, fmt.Errorf("%s: days must be non-negative, batch and interval positive", op)
+	}
+
+	j := &Job{
+		db:    db,
+		cache: cache,
+		log:   log.With("component", "retention", "archive", cfg.Archive),
+		cfg:   cfg,
+	}
+	switch cfg.Archive {
+	case "", config.RetentionArchiveTable:
+	case config.RetentionArchiveFile:
+		j.files = &fileArchive{dir: cfg.Dir}
+	default:
+		return nil, fmt.Errorf("%s: %w: %q", op, ErrUnknownArchive, cfg.Archive)
+	}
+	return j, nil
+}
+
+// Run -- archives the expired orders right away and then every cfg.Interval until ctx is done. Does nothing if retention is
+// disabled.
+func (j *Job) Run(ctx context.Context) {
+	if j.cfg.Days == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := j.Archive(ctx); err != nil && ctx.Err() == nil {
+			j.log.ErrorContext(ctx, "couldn't archive orders", logger.Err(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Archive -- archives and purges the orders created more than cfg.Days ago, cfg.Batch orders per transaction, logging the progress
+// after every batch. Returns the number of archived orders, which are archived even if a later batch fails.
+func (j *Job) Archive(ctx context.Context) (int, error) {
+	const op = "retention.Archive"
+
+	var export func(ctx context.Context, orders []storage.ArchivedOrder) error
+	if j.files != nil {
+		export = j.files.export
+	}
+
+	start := time.Now()
+	before := start.AddDate(0, 0, -j.cfg.Days)
+	j.log.InfoContext(ctx, "archiving orders", "created_before", before)
+
+	total := 0
+	for {
+		uuids, err := j.db.ArchiveOrders(ctx, before, j.cfg.Batch, export)
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", op, err)
+		}
+		if len(uuids) == 0 {
+			break
+		}
+
+		if j.cache != nil {
+			for _, uuid := range uuids {
+				j.cache.Delete(uuid)
+			}
+		}
+		total += len(uuids)
+		metrics.RetentionArchived.Add(float64(len(uuids)))
+		j.log.InfoContext(ctx, "archived batch", "orders", len(uuids), "total", total)
+
+		if len(uuids) < j.cfg.Batch {
+			break
+		}
+	}
+
+	j.log.InfoContext(ctx, "archived orders", "total", total, "took", time.Since(start))
+	return total, nil
+}
+
+// Restore -- brings the archived order back to the live tables. The restored order is archived again only after cfg.Days since it
+// has been restored. Orders archived to files are left in the files, so a restored order which is deleted again can be restored
+// once more. Returns storage.ErrOrderNotFound if the order hasn't been archived and
+// storage.ErrDuplicateOrder if it is live.
+func (j *Job) Restore(ctx context.Context, uuid string) (*storage.Order, error) {
+	const op = "retention.Restore"
+
+	if j.files == nil {
+		order, err := j.db.RestoreArchived(ctx, uuid)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		metrics.RetentionRestored.Inc()
+		return order, nil
+	}
+
+	archived, err := j.files.find(uuid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if err = j.db.RestoreOrder(ctx, archived); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	metrics.RetentionRestored.Inc()
+	return &archived.Order, nil
+}
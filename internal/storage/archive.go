@@ -0,0 +1,14 @@
+package storage
+
+import "time"
+
+// ArchivedOrder -- is the order moved out of the live tables by the retention policy, along with its status history. DeletedAt is
+// set for the orders which had been soft-deleted before they were archived. Missing lists the parts of the order, StageDelivery or
+// StagePayment, which the order had no rows for, as old versions wrote them outside of a transaction; they aren't restored.
+type ArchivedOrder struct {
+	Order      Order        `json:"order"`
+	Events     []OrderEvent `json:"events"`
+	DeletedAt  *time.Time   `json:"deleted_at,omitempty"`
+	Missing    []string     `json:"missing,omitempty"`
+	ArchivedAt time.Time    `json:"archived_at"`
+}
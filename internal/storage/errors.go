@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrOrderNotFound -- there is no order with such order_uid.
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrInvalidCursor -- the listing cursor is malformed.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrDuplicateOrder -- the order with the same order_uid and identical content has already been saved.
+	ErrDuplicateOrder = errors.New("order has already been saved")
+	// ErrOrderConflict -- the order with the same order_uid but different content has already been saved.
+	ErrOrderConflict = errors.New("order with the same order_uid and different content already exists")
+	// ErrVersionMismatch -- the order has been modified since the version the update is based on.
+	ErrVersionMismatch = errors.New("order has been modified")
+	// ErrSnapshotNotFound -- no cache snapshot has been saved yet.
+	ErrSnapshotNotFound = errors.New("cache snapshot not found")
+)
+
+// Stages of an order write, reported by OpError so callers know which part of the order has failed.
+const (
+	StageBegin    = "begin"
+	StageOrder    = "order"
+	StageDelivery = "delivery"
+	StagePayment  = "payment"
+	StageItems    = "items"
+	StageEvents   = "events"
+	StageArchive  = "archive"
+	StageCommit   = "commit"
+)
+
+// OpError -- is returned by storage operations spanning several tables. Op is the failed operation, Stage -- the part of the order
+// it failed on. The whole operation is rolled back when OpError is returned.
+type OpError struct {
+	Op    string
+	Stage string
+	Err   error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Op, e.Stage, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
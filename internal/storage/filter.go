@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+// OrderFilter -- filters and pagination of the order listing. Empty fields aren't filtered by. Orders are listed from the newest
+// by date_created, Cursor is the token returned with the previous page.
+type OrderFilter struct {
+	CustomerID      string
+	TrackNumber     string
+	DeliveryService string
+	CreatedFrom     time.Time
+	CreatedTo       time.Time
+	Bank            string
+	Currency        string
+	Brand           string
+
+	Limit  int
+	Cursor string
+}
+
+// Cursor -- is the position in the order listing: the last order of the previous page.
+type Cursor struct {
+	DateCreated time.Time `json:"d"`
+	OrderID     string    `json:"u"`
+}
+
+// Encode -- encodes the cursor to the opaque token sent to the client.
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor -- decodes the token made by Cursor.Encode. Returns ErrInvalidCursor if the token is malformed.
+func DecodeCursor(token string) (Cursor, error) {
+	var c Cursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+	}
+	if err = json.Unmarshal(data, &c); err != nil || c.OrderID == "" {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursors := []Cursor{
+		{DateCreated: time.Date(2021, 11, 26, 6, 22, 19, 123456000, time.UTC), OrderID: "b563feb7b2b84b6test"},
+		{DateCreated: time.Date(2021, 11, 26, 9, 22, 19, 0, time.FixedZone("MSK", 3*60*60)), OrderID: "a/b+c?d=e"},
+		{OrderID: "zero-date"},
+	}
+	for _, c := range cursors {
+		token := c.Encode()
+		if strings.ContainsAny(token, "+/=") {
+			t.Errorf("token %q isn't URL-safe", token)
+		}
+		got, err := DecodeCursor(token)
+		if err != nil {
+			t.Fatalf("DecodeCursor(%q): %v", token, err)
+		}
+		if got.OrderID != c.OrderID || !got.DateCreated.Equal(c.DateCreated) {
+			t.Fatalf("DecodeCursor() = %+v, want %+v", got, c)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tokens := map[string]string{
+		"empty":            "",
+		"not base64":       "!!!",
+		"padded base64":    base64.URLEncoding.EncodeToString([]byte(`{"u":"ab"}`)),
+		"not JSON":         encode("order"),
+		"without order":    encode(`{"d":"2021-11-26T06:22:19Z"}`),
+		"wrong date":       encode(`{"d":"yesterday","u":"a"}`),
+		"JSON of any type": encode(`["a"]`),
+	}
+	for name, token := range tokens {
+		t.Run(name, func(t *testing.T) {
+			if _, err := DecodeCursor(token); !errors.Is(err, ErrInvalidCursor) {
+				t.Fatalf("DecodeCursor(%q) = %v, want ErrInvalidCursor", token, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"slices"
+	"time"
+)
+
+// ArchiveOrders -- moves up to limit orders created before the given time, soft-deleted ones included, out of the live tables in one
+// transaction. The orders are handed to export, which must have stored them durably once it returns; with nil export they are
+// written to order_archive table. Only the orders handed to export are purged, and only if export succeeds. Returns the uuids of
+// the archived orders, none if there is nothing left to archive.
+func (s *Storage) ArchiveOrders(ctx context.Context, before time.Time, limit int,
+	export func(ctx context.Context, orders []storage.ArchivedOrder) error) (_ []string, err error) {
+	const op = "storage.postgresql.ArchiveOrders"
+	ctx, done := observe(ctx, "archive_orders", attribute.Int("limit", limit))
+	defer func() { done(err) }()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageBegin, Err: err}
+	}
+	defer s.rollback(ctx, tx)
+
+	uuids, deletedAt, err := s.lockExpired(ctx, tx, before, limit)
+	if err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+	if len(uuids) == 0 {
+		return nil, nil
+	}
+
+	archived, err := s.loadArchived(ctx, tx, uuids, deletedAt)
+	if err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+	// the orders locked are purged only if they have been loaded for export
+	uuids = make([]string, len(archived))
+	for i := range archived {
+		uuids[i] = archived[i].Order.OrderID
+	}
+
+	if export != nil {
+		err = export(ctx, archived)
+	} else {
+		err = insertArchive(ctx, tx, archived)
+	}
+	if err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageArchive, Err: err}
+	}
+
+	for _, purge := range []struct{ stage, query string }{
+		{storage.StageItems, purgeItems},
+		{storage.StageDelivery, purgeDelivery},
+		{storage.StagePayment, purgePayment},
+		{storage.StageEvents, purgeEvents},
+		{storage.StageOrder, purgeCache},
+		{storage.StageOrder, purgeOrders},
+	} {
+		if _, err = tx.ExecContext(ctx, purge.query, pq.Array(uuids)); err != nil {
+			return nil, &storage.OpError{Op: op, Stage: purge.stage, Err: err}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageCommit, Err: err}
+	}
+	return uuids, nil
+}
+
+// lockExpired -- locks the batch of orders created before the given time. Returns their uuids and when the soft-deleted ones
+// have been deleted.
+func (s *Storage) lockExpired(ctx context.Context, tx *sql.Tx, before time.Time,
+	limit int) ([]string, map[string]time.Time, error) {
+	rows, err := tx.QueryContext(ctx, lockExpired, before.UTC(), limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.closeRows(ctx, rows)
+
+	var uuids []string
+	deletedAt := make(map[string]time.Time)
+	for rows.Next() {
+		var uuid string
+		var deleted sql.NullTime
+		if err = rows.Scan(&uuid, &deleted); err != nil {
+			return nil, nil, err
+		}
+		uuids = append(uuids, uuid)
+		if deleted.Valid {
+			deletedAt[uuid] = deleted.Time
+		}
+	}
+	return uuids, deletedAt, rows.Err()
+}
+
+// loadArchived -- loads the locked orders with their items and status history.
+func (s *Storage) loadArchived(ctx context.Context, tx *sql.Tx, uuids []string,
+	deletedAt map[string]time.Time) ([]storage.ArchivedOrder, error) {
+	rows, err := tx.QueryContext(ctx, getExpiredTemplate, pq.Array(uuids))
+	if err != nil {
+		return nil, err
+	}
+	archived := make([]storage.ArchivedOrder, 0, len(uuids))
+	for rows.Next() {
+		var a storage.ArchivedOrder
+		if err = scanArchived(rows, &a); err != nil {
+			s.closeRows(ctx, rows)
+			return nil, err
+		}
+		archived = append(archived, a)
+	}
+	s.closeRows(ctx, rows)
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	orders := make([]storage.Order, len(archived))
+	for i := range archived {
+		orders[i] = archived[i].Order
+	}
+	if err = s.attachItems(ctx, orders); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, listEvents, pq.Array(uuids))
+	if err != nil {
+		return nil, err
+	}
+	defer s.closeRows(ctx, rows)
+	events := make(map[string][]storage.OrderEvent, len(orders))
+	for rows.Next() {
+		var event storage.OrderEvent
+		if err = rows.Scan(&event.ID, &event.OrderID, &event.From, &event.To, &event.Reason, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		events[event.OrderID] = append(events[event.OrderID], event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	for i := range archived {
+		uuid := archived[i].Order.OrderID
+		archived[i].Order.Items = orders[i].Items
+		archived[i].Events = events[uuid]
+		archived[i].ArchivedAt = now
+		if deleted, ok := deletedAt[uuid]; ok {
+			archived[i].DeletedAt = &deleted
+		}
+	}
+	return archived, nil
+}
+
+// scanArchived -- scans the order selected by getExpiredTemplate, noting its missing delivery or payment.
+func scanArchived(rows *sql.Rows, a *storage.ArchivedOrder) error {
+	order := &a.Order
+	var hasDelivery, hasPayment bool
+	err := rows.Scan(
+		&order.OrderID, &order.TrackNum, &order.Entry, &order.Locale, &order.InternalSignature,
+		&order.CustomerId, &order.DeliveryService, &order.Shardkey, &order.SmId, &order.DateCreated, &order.OofShard,
+		&order.Status, &order.Version,
+		&hasDelivery, &order.Delivery.Name, &order.Delivery.Phone, &order.Delivery.Zip, &order.Delivery.City,
+		&order.Delivery.Address, &order.Delivery.Region, &order.Delivery.Email,
+		&hasPayment, &order.Payment.ReqID, &order.Payment.Currency, &order.Payment.Provider, &order.Payment.Amount,
+		&order.Payment.PaymentDt, &order.Payment.Bank, &order.Payment.DeliveryCost, &order.Payment.GoodsTotal,
+		&order.Payment.CustomFee,
+	)
+	if err != nil {
+		return fmt.Errorf("error parsing archived order: %w", err)
+	}
+	order.Payment.Transaction = order.OrderID
+	if !hasDelivery {
+		a.Missing = append(a.Missing, storage.StageDelivery)
+	}
+	if !hasPayment {
+		a.Missing = append(a.Missing, storage.StagePayment)
+	}
+	return nil
+}
+
+// insertArchive -- writes the orders to order_archive table.
+func insertArchive(ctx context.Context, tx *sql.Tx, archived []storage.ArchivedOrder) error {
+	for i := range archived {
+		data, err := json.Marshal(&archived[i])
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, archiveOrder, archived[i].Order.OrderID, archived[i].Order.DateCreated.UTC(), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreArchived -- brings the order archived to order_archive table back to the live tables and removes it from the archive.
+// Returns storage.ErrOrderNotFound if there is no such archived order and storage.ErrDuplicateOrder if the order is live.
+func (s *Storage) RestoreArchived(ctx context.Context, uuid string) (_ *storage.Order, err error) {
+	const op = "storage.postgresql.RestoreArchived"
+	ctx, done := observe(ctx, "restore_archived", attribute.String("order_uid", uuid))
+	defer func() { done(err) }()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageBegin, Err: err}
+	}
+	defer s.rollback(ctx, tx)
+
+	var data []byte
+	if err = tx.QueryRowContext(ctx, getArchived, uuid).Scan(&data); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%s: %s: %w", op, uuid, storage.ErrOrderNotFound)
+		}
+		return nil, &storage.OpError{Op: op, Stage: storage.StageArchive, Err: err}
+	}
+	var archived storage.ArchivedOrder
+	if err = json.Unmarshal(data, &archived); err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageArchive, Err: err}
+	}
+
+	if err = insertRestored(ctx, tx, &archived); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.ExecContext(ctx, deleteArchived, uuid); err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageArchive, Err: err}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageCommit, Err: err}
+	}
+	return &archived.Order, nil
+}
+
+// RestoreOrder -- brings the order archived elsewhere, e.g. to a file, back to the live tables with its status history. Returns
+// storage.ErrDuplicateOrder if the order is live.
+func (s *Storage) RestoreOrder(ctx context.Context, archived *storage.ArchivedOrder) (err error) {
+	const op = "storage.postgresql.RestoreOrder"
+	ctx, done := observe(ctx, "restore_order", attribute.String("order_uid", archived.Order.OrderID))
+	defer func() { done(err) }()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageBegin, Err: err}
+	}
+	defer s.rollback(ctx, tx)
+
+	if err = insertRestored(ctx, tx, archived); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageCommit, Err: err}
+	}
+	return nil
+}
+
+// insertRestored -- inserts the archived order keeping its status, version and events. restored_at is set, so the order isn't
+// archived again until the retention period passes since now.
+func insertRestored(ctx context.Context, tx *sql.Tx, archived *storage.ArchivedOrder) error {
+	const op = "storage.postgresql.insertRestored"
+	order := &archived.Order
+
+	res, err := tx.ExecContext(ctx, restoreOrder,
+		order.OrderID, order.TrackNum, order.Entry, order.Locale,
+		order.InternalSignature, order.CustomerId, order.DeliveryService,
+		order.Shardkey, order.SmId, order.DateCreated.UTC(), order.OofShard, order.Status, order.Version,
+		archived.DeletedAt,
+	)
+	if err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+	if inserted, err := res.RowsAffected(); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	} else if inserted == 0 {
+		return fmt.Errorf("%s: %w", order.OrderID, storage.ErrDuplicateOrder)
+	}
+
+	if !slices.Contains(archived.Missing, storage.StageDelivery) {
+		_, err = tx.ExecContext(ctx, saveDelivery,
+			order.OrderID, order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip,
+			order.Delivery.City, order.Delivery.Address, order.Delivery.Region,
+			order.Delivery.Email,
+		)
+		if err != nil {
+			return &storage.OpError{Op: op, Stage: storage.StageDelivery, Err: err}
+		}
+	}
+
+	if !slices.Contains(archived.Missing, storage.StagePayment) {
+		_, err = tx.ExecContext(ctx, savePayment,
+			order.OrderID, order.Payment.ReqID, order.Payment.Currency,
+			order.Payment.Provider, order.Payment.Amount, order.Payment.PaymentDt,
+			order.Payment.Bank, order.Payment.DeliveryCost, order.Payment.GoodsTotal,
+			order.Payment.CustomFee,
+		)
+		if err != nil {
+			return &storage.OpError{Op: op, Stage: storage.StagePayment, Err: err}
+		}
+	}
+
+	if err = insertItems(ctx, tx, order); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageItems, Err: err}
+	}
+
+	for _, event := range archived.Events {
+		_, err = tx.ExecContext(ctx, restoreEvent, event.ID, order.OrderID, event.From, event.To, event.Reason, event.CreatedAt)
+		if err != nil {
+			return &storage.OpError{Op: op, Stage: storage.StageEvents, Err: err}
+		}
+	}
+	return nil
+}
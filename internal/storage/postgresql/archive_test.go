@@ -0,0 +1,140 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"io"
+	"log/slog"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
+
+// arrayArg -- matches the pq.Array of the given uuids.
+type arrayArg []string
+
+func (a arrayArg) Match(v driver.Value) bool {
+	want, _ := pq.Array([]string(a)).Value()
+	return v == want
+}
+
+func newMockStorage(t *testing.T) (*Storage, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return &Storage{db: db, log: slog.New(slog.NewTextHandler(io.Discard, nil))}, mock
+}
+
+var expiredColumns = []string{
+	"order_uid", "track_number", "entry", "locale", "internal_signature", "customer_id", "delivery_service", "shardkey", "sm_id",
+	"date_created", "oof_shard", "status", "version",
+	"has_delivery", "fio", "phone", "zip", "city", "address", "region", "email",
+	"has_payment", "request_id", "currency", "provider", "amount", "payment_dt", "bank", "delivery_cost", "goods_total", "custom_fee",
+}
+
+func expiredRow(uuid string, created time.Time, hasDelivery, hasPayment bool) []driver.Value {
+	return []driver.Value{
+		uuid, "WBILMTESTTRACK", "WBIL", "en", "", "test", "meest", "9", int64(99), created, "1", "created", int64(1),
+		hasDelivery, "Test Testov", "+9720000000", "2639809", "Kiryat Mozkin", "Ploshad Mira 15", "Kraiot", "test@gmail.com",
+		hasPayment, "", "USD", "wbpay", int64(1817), int64(1637907727), "alpha", int64(1500), int64(317), int64(0),
+	}
+}
+
+// expectArchive -- expects one ArchiveOrders transaction: locked are the orders picked by lockExpired, loaded -- the rows of
+// getExpiredTemplate, purged -- the uuids the purge statements must get.
+func expectArchive(mock sqlmock.Sqlmock, created time.Time, locked []string, loaded [][]driver.Value, purged []string) {
+	mock.ExpectBegin()
+	lockedRows := sqlmock.NewRows([]string{"order_uid", "deleted_at"})
+	for _, uuid := range locked {
+		lockedRows.AddRow(uuid, nil)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(lockExpired)).WillReturnRows(lockedRows)
+
+	expired := sqlmock.NewRows(expiredColumns)
+	for _, row := range loaded {
+		expired.AddRow(row...)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(getExpiredTemplate)).WithArgs(arrayArg(locked)).WillReturnRows(expired)
+	mock.ExpectQuery(regexp.QuoteMeta(listItemsTemplate)).WillReturnRows(sqlmock.NewRows([]string{
+		"order_uid", "chrt_id", "track_number", "price", "rid", "iname", "sale", "isize", "total_price", "nm_id", "brand", "status",
+	}))
+	mock.ExpectQuery(regexp.QuoteMeta(listEvents)).WillReturnRows(sqlmock.NewRows([]string{
+		"id", "order_uid", "from_status", "to_status", "reason", "created_at",
+	}).AddRow(int64(1), locked[0], "", "created", "", created))
+
+	for _, query := range []string{purgeItems, purgeDelivery, purgePayment, purgeEvents, purgeCache, purgeOrders} {
+		mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(arrayArg(purged)).WillReturnResult(sqlmock.NewResult(0, int64(len(purged))))
+	}
+	mock.ExpectCommit()
+}
+
+func TestArchiveOrdersMissingParts(t *testing.T) {
+	s, mock := newMockStorage(t)
+	created := time.Date(2021, 11, 26, 6, 22, 19, 0, time.UTC)
+
+	expectArchive(mock, created, []string{"full", "no-delivery", "no-payment"}, [][]driver.Value{
+		expiredRow("full", created, true, true),
+		expiredRow("no-delivery", created, false, true),
+		expiredRow("no-payment", created, true, false),
+	}, []string{"full", "no-delivery", "no-payment"})
+
+	var exported []storage.ArchivedOrder
+	uuids, err := s.ArchiveOrders(context.Background(), created.Add(time.Hour), 10,
+		func(_ context.Context, orders []storage.ArchivedOrder) error {
+			exported = orders
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(uuids, []string{"full", "no-delivery", "no-payment"}) {
+		t.Fatalf("archived %v", uuids)
+	}
+	missing := make(map[string][]string)
+	for _, a := range exported {
+		missing[a.Order.OrderID] = a.Missing
+	}
+	if len(exported) != 3 || len(missing["full"]) != 0 ||
+		!slices.Equal(missing["no-delivery"], []string{storage.StageDelivery}) ||
+		!slices.Equal(missing["no-payment"], []string{storage.StagePayment}) {
+		t.Fatalf("exported orders miss %v", missing)
+	}
+}
+
+func TestArchiveOrdersPurgesExportedOnly(t *testing.T) {
+	s, mock := newMockStorage(t)
+	created := time.Date(2021, 11, 26, 6, 22, 19, 0, time.UTC)
+
+	// "gone" is locked but not loaded, it mustn't be purged without being archived
+	expectArchive(mock, created, []string{"kept", "gone"}, [][]driver.Value{
+		expiredRow("kept", created, true, true),
+	}, []string{"kept"})
+
+	uuids, err := s.ArchiveOrders(context.Background(), created.Add(time.Hour), 10,
+		func(_ context.Context, orders []storage.ArchivedOrder) error {
+			if len(orders) != 1 || orders[0].Order.OrderID != "kept" {
+				t.Errorf("exported %v", orders)
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(uuids, []string{"kept"}) {
+		t.Fatalf("archived %v", uuids)
+	}
+}
@@ -0,0 +1,166 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// SaveOrders -- saves the batch of orders in one transaction, copying every table with COPY. Returns the error of every order by its
+// index: nil if it has been saved, storage.ErrDuplicateOrder or storage.ErrOrderConflict if it already exists, in the storage or
+// earlier in the batch. If the bulk write fails, e.g. on the constraint violated by one of the orders, the orders are saved one by
+// one with SaveOrder, so only the offending ones fail.
+func (s *Storage) SaveOrders(ctx context.Context, orders []storage.Order) []error {
+	const op = "storage.postgresql.SaveOrders"
+
+	errs := make([]error, len(orders))
+	pending, err := s.saveBatch(ctx, orders, errs)
+	if err == nil {
+		return errs
+	}
+	if ctx.Err() != nil {
+		for _, i := range pending {
+			errs[i] = fmt.Errorf("%s: %w", op, err)
+		}
+		return errs
+	}
+
+	s.log.WarnContext(ctx, "couldn't save batch, saving orders one by one", "orders", len(pending), logger.Err(err))
+	for _, i := range pending {
+		errs[i] = s.SaveOrder(ctx, &orders[i])
+	}
+	return errs
+}
+
+// saveBatch -- sets errs of the orders which already exist and copies the rest. Returns the indexes of the copied orders, which
+// are left unsaved if the error is returned.
+func (s *Storage) saveBatch(ctx context.Context, orders []storage.Order, errs []error) (pending []int, err error) {
+	const op = "storage.postgresql.SaveOrders"
+	ctx, done := observe(ctx, "save_orders", attribute.Int("orders", len(orders)))
+	defer func() { done(err) }()
+
+	uuids := make([]string, len(orders))
+	for i := range orders {
+		uuids[i] = orders[i].OrderID
+	}
+	existing, err := s.GetOrders(ctx, uuids)
+	if err != nil {
+		for i := range orders {
+			pending = append(pending, i)
+		}
+		return pending, &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+
+	seen := make(map[string]*storage.Order, len(orders))
+	for i := range existing {
+		seen[existing[i].OrderID] = &existing[i]
+	}
+	for i := range orders {
+		order := &orders[i]
+		if prev, ok := seen[order.OrderID]; ok {
+			if prev.Equal(order) {
+				errs[i] = fmt.Errorf("%s: %s: %w", op, order.OrderID, storage.ErrDuplicateOrder)
+			} else {
+				errs[i] = fmt.Errorf("%s: %s: %w", op, order.OrderID, storage.ErrOrderConflict)
+			}
+			continue
+		}
+		seen[order.OrderID] = order
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return pending, &storage.OpError{Op: op, Stage: storage.StageBegin, Err: err}
+	}
+	defer s.rollback(ctx, tx)
+
+	err = copyIn(ctx, tx, pq.CopyIn("orders", "order_uid", "track_number", "entry", "locale", "internal_signature",
+		"customer_id", "delivery_service", "shardkey", "sm_id", "date_created", "oof_shard", "status"), pending,
+		func(i int) [][]any {
+			o := &orders[i]
+			return [][]any{{o.OrderID, o.TrackNum, o.Entry, o.Locale, o.InternalSignature, o.CustomerId, o.DeliveryService,
+				o.Shardkey, o.SmId, o.DateCreated.UTC(), o.OofShard, storage.StatusCreated}}
+		})
+	if err != nil {
+		return pending, &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+
+	err = copyIn(ctx, tx, pq.CopyIn("delivery", "order_uid", "fio", "phone", "zip", "city", "address", "region",
+		"email"), pending, func(i int) [][]any {
+		o := &orders[i]
+		d := &o.Delivery
+		return [][]any{{o.OrderID, d.Name, d.Phone, d.Zip, d.City, d.Address, d.Region, d.Email}}
+	})
+	if err != nil {
+		return pending, &storage.OpError{Op: op, Stage: storage.StageDelivery, Err: err}
+	}
+
+	err = copyIn(ctx, tx, pq.CopyIn("payment", "transact", "request_id", "currency", "provider", "amount", "payment_dt",
+		"bank", "delivery_cost", "goods_total", "custom_fee"), pending, func(i int) [][]any {
+		p := &orders[i].Payment
+		return [][]any{{p.Transaction, p.ReqID, p.Currency, p.Provider, p.Amount, p.PaymentDt, p.Bank, p.DeliveryCost,
+			p.GoodsTotal, p.CustomFee}}
+	})
+	if err != nil {
+		return pending, &storage.OpError{Op: op, Stage: storage.StagePayment, Err: err}
+	}
+
+	err = copyIn(ctx, tx, pq.CopyIn("items", "order_uid", "line", "chrt_id", "track_number", "price", "rid", "iname", "sale",
+		"isize", "total_price", "nm_id", "brand", "status"), pending, func(i int) [][]any {
+		rows := make([][]any, len(orders[i].Items))
+		for j, item := range orders[i].Items {
+			rows[j] = []any{orders[i].OrderID, j, item.ChrtID, item.TrackNumber, item.Price, item.Rid, item.Name, item.Sale, item.Size,
+				item.TotalPrice, item.NmID, item.Brand, item.Status}
+		}
+		return rows
+	})
+	if err != nil {
+		return pending, &storage.OpError{Op: op, Stage: storage.StageItems, Err: err}
+	}
+
+	err = copyIn(ctx, tx, pq.CopyIn("order_events", "order_uid", "to_status"), pending, func(i int) [][]any {
+		return [][]any{{orders[i].OrderID, storage.StatusCreated}}
+	})
+	if err != nil {
+		return pending, &storage.OpError{Op: op, Stage: storage.StageEvents, Err: err}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return pending, &storage.OpError{Op: op, Stage: storage.StageCommit, Err: err}
+	}
+	return nil, nil
+}
+
+// copyIn -- copies the rows of every pending order with the COPY statement made by pq.CopyIn.
+func copyIn(ctx context.Context, tx *sql.Tx, query string, pending []int, rows func(i int) [][]any) (err error) {
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := stmt.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	for _, i := range pending {
+		for _, row := range rows(i) {
+			if _, err = stmt.ExecContext(ctx, row...); err != nil {
+				return err
+			}
+		}
+	}
+	// flushes the buffered rows, the constraints are checked here
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+// benchStorage -- connects to the database by L0_TEST_DSN and migrates it, skips the benchmark if it isn't set.
+func benchStorage(b *testing.B) *Storage {
+	b.Helper()
+	dsn := os.Getenv("L0_TEST_DSN")
+	if dsn == "" {
+		b.Skip("L0_TEST_DSN isn't set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = db.Close() })
+
+	s := &Storage{db: db, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if _, err = s.Migrate(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
+
+// benchOrders -- returns n random orders unique across the benchmark runs.
+func benchOrders(prefix string, n int) []storage.Order {
+	run := time.Now().UnixNano()
+	orders := make([]storage.Order, n)
+	for i := range orders {
+		orders[i] = *storage.RandomOrder(fmt.Sprintf("%s-%d-%d", prefix, run, i))
+	}
+	return orders
+}
+
+// BenchmarkSaveOrders -- measures the throughput of the bulk write and of saving the same orders one by one, reported as orders/s.
+// No speed-up is asserted, the numbers depend on the database: run it with L0_TEST_DSN pointing to a disposable one, e.g.
+// L0_TEST_DSN="postgres://postgres@localhost/l0_bench?sslmode=disable" go test -run - -bench SaveOrders ./internal/storage/postgresql
+func BenchmarkSaveOrders(b *testing.B) {
+	s := benchStorage(b)
+	ctx := context.Background()
+
+	for _, size := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("batch-%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				orders := benchOrders("bench-batch", size)
+				b.StartTimer()
+				for _, err := range s.SaveOrders(ctx, orders) {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N*size)/b.Elapsed().Seconds(), "orders/s")
+		})
+		b.Run(fmt.Sprintf("single-%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				orders := benchOrders("bench-single", size)
+				b.StartTimer()
+				for j := range orders {
+					if err := s.SaveOrder(ctx, &orders[j]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N*size)/b.Elapsed().Seconds(), "orders/s")
+		})
+	}
+}
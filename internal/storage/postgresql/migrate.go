@@ -0,0 +1,242 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock -- is the key of the advisory lock held while migrating, so instances started together don't race.
+const migrationLock = 0x4c30_6d69_6772
+
+// ErrMigrationMissing -- the applied schema version has no embedded migration, the database is newer than the service.
+var ErrMigrationMissing = errors.New("applied migration is missing")
+
+// Migration -- is one schema change, applied by Up and reverted by Down. Migrations are embedded from migrations/ directory named
+// <version>_<name>.up.sql and <version>_<name>.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrations -- returns the embedded migrations ordered by version.
+func Migrations() ([]Migration, error) {
+	return parseMigrations(migrationFiles)
+}
+
+// parseMigrations -- reads the migrations of migrations/ directory of fsys ordered by version. Every version must have exactly one
+// up and one down script.
+func parseMigrations(fsys fs.FS) ([]Migration, error) {
+	const op = "storage.postgresql.Migrations"
+
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		base := path.Base(file)
+		prefix, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("%s: malformed migration name %s", op, base)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed migration version %s", op, base)
+		}
+
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+		}
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			if m.Up != "" {
+				return nil, fmt.Errorf("%s: duplicate up migration %d", op, version)
+			}
+			m.Name, m.Up = strings.TrimSuffix(name, ".up.sql"), string(data)
+		case strings.HasSuffix(name, ".down.sql"):
+			if m.Down != "" {
+				return nil, fmt.Errorf("%s: duplicate down migration %d", op, version)
+			}
+			m.Down = string(data)
+		default:
+			return nil, fmt.Errorf("%s: migration %s is neither up nor down", op, base)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%s: migration %d must have both up and down", op, m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrate -- applies all the pending migrations, each in its own transaction. Returns the schema version.
+func (s *Storage) Migrate(ctx context.Context) (int, error) {
+	const op = "storage.postgresql.Migrate"
+
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = s.migrating(ctx, func(conn *sql.Conn, applied map[int]bool) error {
+		for _, m := range migrations {
+			if applied[m.Version] {
+				version = m.Version
+				continue
+			}
+			if err := s.apply(ctx, conn, m.Up, insertMigration, m.Version, m.Name); err != nil {
+				return fmt.Errorf("%d_%s: %w", m.Version, m.Name, err)
+			}
+			s.log.InfoContext(ctx, "applied migration", "version", m.Version, "name", m.Name)
+			version = m.Version
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return version, nil
+}
+
+// MigrateDown -- reverts the steps last applied migrations. Returns the schema version.
+func (s *Storage) MigrateDown(ctx context.Context, steps int) (int, error) {
+	const op = "storage.postgresql.MigrateDown"
+
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	var version int
+	err = s.migrating(ctx, func(conn *sql.Conn, applied map[int]bool) error {
+		versions := make([]int, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+		for i, v := range versions {
+			if i == steps {
+				version = v
+				return nil
+			}
+			m, ok := byVersion[v]
+			if !ok {
+				return fmt.Errorf("%w: %d", ErrMigrationMissing, v)
+			}
+			if err := s.apply(ctx, conn, m.Down, deleteMigration, m.Version); err != nil {
+				return fmt.Errorf("%d_%s: %w", m.Version, m.Name, err)
+			}
+			s.log.InfoContext(ctx, "reverted migration", "version", m.Version, "name", m.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return version, nil
+}
+
+// SchemaVersion -- returns the last applied migration, 0 if there are none.
+func (s *Storage) SchemaVersion(ctx context.Context) (int, error) {
+	const op = "storage.postgresql.SchemaVersion"
+
+	if _, err := s.db.ExecContext(ctx, createMigrations); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	var version int
+	if err := s.db.QueryRowContext(ctx, schemaVersion).Scan(&version); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return version, nil
+}
+
+// migrating -- runs fn on the connection holding the migration lock with the set of applied versions.
+func (s *Storage) migrating(ctx context.Context, fn func(conn *sql.Conn, applied map[int]bool) error) (err error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, lockMigrations, migrationLock); err != nil {
+		return err
+	}
+	defer func() {
+		if _, unlockErr := conn.ExecContext(context.Background(), unlockMigrations, migrationLock); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}()
+
+	if _, err = conn.ExecContext(ctx, createMigrations); err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, appliedMigrations)
+	if err != nil {
+		return err
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			s.closeRows(ctx, rows)
+			return err
+		}
+		applied[version] = true
+	}
+	s.closeRows(ctx, rows)
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return fn(conn, applied)
+}
+
+// apply -- executes the migration script and records it in schema_migrations in one transaction.
+func (s *Storage) apply(ctx context.Context, conn *sql.Conn, script, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer s.rollback(ctx, tx)
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
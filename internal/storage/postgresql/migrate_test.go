@@ -0,0 +1,109 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
+	"regexp"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseMigrations(t *testing.T) {
+	script := &fstest.MapFile{Data: []byte("SELECT 1;")}
+	tests := []struct {
+		name    string
+		files   []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "ordered by version",
+			files: []string{"0010_b.up.sql", "0010_b.down.sql", "0002_a.up.sql", "0002_a.down.sql"},
+			want:  "[2_a 10_b]",
+		},
+		{name: "no migrations", want: "[]"},
+		{name: "missing down", files: []string{"0001_a.up.sql"}, wantErr: true},
+		{name: "missing up", files: []string{"0001_a.down.sql"}, wantErr: true},
+		{
+			name:    "duplicate version",
+			files:   []string{"0001_a.up.sql", "0001_a.down.sql", "0001_b.up.sql", "0001_b.down.sql"},
+			wantErr: true,
+		},
+		{name: "no name", files: []string{"0001.up.sql"}, wantErr: true},
+		{name: "malformed version", files: []string{"v1_a.up.sql", "v1_a.down.sql"}, wantErr: true},
+		{name: "neither up nor down", files: []string{"0001_a.up.sql", "0001_a.down.sql", "0001_a.sql"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for _, file := range tt.files {
+				fsys["migrations/"+file] = script
+			}
+
+			migrations, err := parseMigrations(fsys)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseMigrations() = %v, want error", migrations)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMigrations(): %v", err)
+			}
+			got := make([]string, 0, len(migrations))
+			for _, m := range migrations {
+				got = append(got, fmt.Sprintf("%d_%s", m.Version, m.Name))
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Fatalf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatalf("Migrations(): %v", err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d_%s, want version %d", m.Version, m.Name, i+1)
+		}
+	}
+}
+
+func TestMigrateSkipsApplied(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, mock := newMockStorage(t)
+
+	applied := sqlmock.NewRows([]string{"version"})
+	for _, m := range migrations[:len(migrations)-1] {
+		applied.AddRow(m.Version)
+	}
+	last := migrations[len(migrations)-1]
+
+	mock.ExpectExec(regexp.QuoteMeta(lockMigrations)).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(createMigrations)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(appliedMigrations)).WillReturnRows(applied)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(last.Up)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(insertMigration)).WithArgs(last.Version, last.Name).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta(unlockMigrations)).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	version, err := s.Migrate(context.Background())
+	if err != nil {
+		t.Fatalf("Migrate(): %v", err)
+	}
+	if version != last.Version {
+		t.Fatalf("Migrate() = %d, want %d", version, last.Version)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,63 @@
+CREATE TABLE IF NOT EXISTS orders
+(
+    order_uid  VARCHAR(64) PRIMARY KEY,
+    track_number  VARCHAR(64) UNIQUE,
+    entry  VARCHAR(64),
+    locale  VARCHAR(10),
+    internal_signature  VARCHAR(64),
+    customer_id  VARCHAR(64),
+    delivery_service  VARCHAR(64),
+    shardkey VARCHAR(64),
+    sm_id  BIGINT,
+    date_created  timestamp,
+    oof_shard  VARCHAR(32)
+);
+
+CREATE TABLE IF NOT EXISTS delivery
+(
+	track_number VARCHAR(64)  PRIMARY KEY,
+	fio VARCHAR(64),
+	phone VARCHAR(16),
+	zip VARCHAR(16),
+	city VARCHAR(32),
+	address VARCHAR(64),
+	region VARCHAR(32),
+	email VARCHAR(64),
+	FOREIGN KEY (track_number) REFERENCES orders(track_number)
+);
+
+CREATE TABLE IF NOT EXISTS payment
+(
+	transact VARCHAR(64) UNIQUE,
+	request_id VARCHAR(64),
+	currency VARCHAR(8),
+	provider VARCHAR(32),
+	amount BIGINT CHECK(delivery_cost >= 0),
+	payment_dt BIGINT CHECK(payment_dt > 0),
+	bank VARCHAR(32),
+	delivery_cost INT CHECK(delivery_cost > 0),
+	goods_total BIGINT CHECK(goods_total > 0),
+	custom_fee SMALLINT CHECK(custom_fee >= 0),
+	FOREIGN KEY (transact) REFERENCES orders(order_uid)
+);
+
+CREATE TABLE IF NOT EXISTS items
+(
+	chrt_id BIGINT PRIMARY KEY,
+	track_number VARCHAR(128),
+	price BIGINT,
+	rid VARCHAR(64) UNIQUE,
+	iname VARCHAR(32),
+	sale SMALLINT CHECK (sale >= 0),
+	isize VARCHAR(16),
+	total_price INT CHECK (total_price > 0),
+	nm_id INT CHECK (nm_id > 0),
+	brand VARCHAR(32),
+	status INT CHECK (status >= 0),
+	FOREIGN KEY (track_number) REFERENCES orders(track_number)
+);
+
+CREATE TABLE IF NOT EXISTS cached
+(
+	order_uid VARCHAR(64) PRIMARY KEY
+);
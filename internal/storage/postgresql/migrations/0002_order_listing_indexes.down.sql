@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS orders_date_created_idx, orders_customer_id_idx, orders_delivery_service_idx, payment_bank_idx,
+	payment_currency_idx, items_track_number_idx, items_brand_idx;
@@ -0,0 +1,7 @@
+CREATE INDEX IF NOT EXISTS orders_date_created_idx ON orders (date_created DESC, order_uid DESC);
+CREATE INDEX IF NOT EXISTS orders_customer_id_idx ON orders (customer_id, date_created DESC);
+CREATE INDEX IF NOT EXISTS orders_delivery_service_idx ON orders (delivery_service, date_created DESC);
+CREATE INDEX IF NOT EXISTS payment_bank_idx ON payment (bank);
+CREATE INDEX IF NOT EXISTS payment_currency_idx ON payment (currency);
+CREATE INDEX IF NOT EXISTS items_track_number_idx ON items (track_number);
+CREATE INDEX IF NOT EXISTS items_brand_idx ON items (brand, track_number);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS cache_snapshot
+(
+	id SMALLINT PRIMARY KEY CHECK (id = 1),
+	data BYTEA NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT now()
+);
@@ -0,0 +1,28 @@
+-- Fails if orders share a track number or items share chrt_id or rid, as the old schema can't keep them.
+
+DROP INDEX IF EXISTS orders_track_number_idx;
+ALTER TABLE orders ADD CONSTRAINT orders_track_number_key UNIQUE (track_number);
+
+ALTER TABLE delivery ADD COLUMN track_number VARCHAR(64);
+UPDATE delivery d SET track_number = o.track_number FROM orders o WHERE o.order_uid = d.order_uid;
+
+ALTER TABLE delivery
+	DROP CONSTRAINT delivery_pkey,
+	DROP CONSTRAINT delivery_order_uid_fkey,
+	DROP COLUMN order_uid,
+	ADD CONSTRAINT delivery_pkey PRIMARY KEY (track_number),
+	ADD CONSTRAINT delivery_track_number_fkey FOREIGN KEY (track_number) REFERENCES orders(track_number);
+
+DROP INDEX IF EXISTS items_brand_idx;
+
+ALTER TABLE items
+	DROP CONSTRAINT items_pkey,
+	DROP CONSTRAINT items_order_uid_fkey,
+	DROP COLUMN order_uid,
+	DROP COLUMN line,
+	ADD CONSTRAINT items_pkey PRIMARY KEY (chrt_id),
+	ADD CONSTRAINT items_rid_key UNIQUE (rid),
+	ADD CONSTRAINT items_track_number_fkey FOREIGN KEY (track_number) REFERENCES orders(track_number);
+
+CREATE INDEX IF NOT EXISTS items_track_number_idx ON items (track_number);
+CREATE INDEX IF NOT EXISTS items_brand_idx ON items (brand, track_number);
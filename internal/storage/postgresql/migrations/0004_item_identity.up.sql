@@ -0,0 +1,36 @@
+-- Items are keyed by their order and position in it, so chrt_id, nm_id and rid are plain attributes. Delivery is keyed by order
+-- as well, so several orders may share a track number.
+
+ALTER TABLE items ADD COLUMN order_uid VARCHAR(64), ADD COLUMN line INT;
+UPDATE items i SET order_uid = o.order_uid FROM orders o WHERE o.track_number = i.track_number;
+-- the original position is unknown, items are numbered in the order they were inserted
+WITH numbered AS (
+	SELECT chrt_id, ROW_NUMBER() OVER (PARTITION BY order_uid ORDER BY ctid) - 1 AS line FROM items
+)
+UPDATE items i SET line = n.line FROM numbered n WHERE i.chrt_id = n.chrt_id;
+
+ALTER TABLE items
+	DROP CONSTRAINT items_pkey,
+	DROP CONSTRAINT items_rid_key,
+	DROP CONSTRAINT items_track_number_fkey,
+	ALTER COLUMN order_uid SET NOT NULL,
+	ALTER COLUMN line SET NOT NULL,
+	ADD CONSTRAINT items_pkey PRIMARY KEY (order_uid, line),
+	ADD CONSTRAINT items_order_uid_fkey FOREIGN KEY (order_uid) REFERENCES orders(order_uid);
+
+DROP INDEX IF EXISTS items_track_number_idx, items_brand_idx;
+CREATE INDEX items_brand_idx ON items (brand, order_uid);
+
+ALTER TABLE delivery ADD COLUMN order_uid VARCHAR(64);
+UPDATE delivery d SET order_uid = o.order_uid FROM orders o WHERE o.track_number = d.track_number;
+
+ALTER TABLE delivery
+	DROP CONSTRAINT delivery_pkey,
+	DROP CONSTRAINT delivery_track_number_fkey,
+	DROP COLUMN track_number,
+	ALTER COLUMN order_uid SET NOT NULL,
+	ADD CONSTRAINT delivery_pkey PRIMARY KEY (order_uid),
+	ADD CONSTRAINT delivery_order_uid_fkey FOREIGN KEY (order_uid) REFERENCES orders(order_uid);
+
+ALTER TABLE orders DROP CONSTRAINT orders_track_number_key;
+CREATE INDEX orders_track_number_idx ON orders (track_number);
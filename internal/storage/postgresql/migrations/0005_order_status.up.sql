@@ -0,0 +1,17 @@
+ALTER TABLE orders ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'created';
+
+CREATE TABLE IF NOT EXISTS order_events
+(
+	id BIGSERIAL PRIMARY KEY,
+	order_uid VARCHAR(64) NOT NULL REFERENCES orders(order_uid),
+	from_status VARCHAR(16),
+	to_status VARCHAR(16) NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS order_events_order_uid_idx ON order_events (order_uid, id);
+
+-- orders saved before are considered created at date_created
+INSERT INTO order_events (order_uid, to_status, created_at)
+SELECT order_uid, 'created', COALESCE(date_created, now()) FROM orders;
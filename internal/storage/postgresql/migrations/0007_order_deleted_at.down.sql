@@ -0,0 +1,8 @@
+-- soft-deleted orders are purged, as without deleted_at they would come back to life
+DELETE FROM items WHERE order_uid IN (SELECT order_uid FROM orders WHERE deleted_at IS NOT NULL);
+DELETE FROM delivery WHERE order_uid IN (SELECT order_uid FROM orders WHERE deleted_at IS NOT NULL);
+DELETE FROM payment WHERE transact IN (SELECT order_uid FROM orders WHERE deleted_at IS NOT NULL);
+DELETE FROM order_events WHERE order_uid IN (SELECT order_uid FROM orders WHERE deleted_at IS NOT NULL);
+DELETE FROM orders WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE orders DROP COLUMN deleted_at;
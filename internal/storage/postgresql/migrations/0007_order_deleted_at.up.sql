@@ -0,0 +1 @@
+ALTER TABLE orders ADD COLUMN deleted_at TIMESTAMP;
@@ -0,0 +1,3 @@
+ALTER TABLE orders DROP COLUMN restored_at;
+
+DROP TABLE IF EXISTS order_archive;
@@ -0,0 +1,13 @@
+-- orders moved out by the retention policy, data is storage.ArchivedOrder
+CREATE TABLE IF NOT EXISTS order_archive
+(
+	order_uid VARCHAR(64) PRIMARY KEY,
+	date_created TIMESTAMP,
+	archived_at TIMESTAMP NOT NULL DEFAULT now(),
+	data JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_archive_date_created_idx ON order_archive (date_created);
+
+-- restored orders are archived again only after the retention period since they have been restored
+ALTER TABLE orders ADD COLUMN restored_at TIMESTAMP;
@@ -1,21 +1,36 @@
 package postgresql
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/wlcmtunknwndth/L0_WB/internal/config"
+	"github.com/wlcmtunknwndth/L0_WB/internal/logger"
+	"github.com/wlcmtunknwndth/L0_WB/internal/metrics"
 	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Storage struct {
-	db *sql.DB
+	db  *sql.DB
+	log *slog.Logger
+	// softDelete -- Delete marks orders with deleted_at instead of removing them.
+	softDelete bool
 }
 
-// New -- creates new instance of storage.Storage.
-func New(config config.DbConfig) (*Storage, error) {
+var tracer = otel.Tracer("storage/postgresql")
+
+// New -- creates new instance of storage.Storage. Returns the error if the db can't be reached.
+func New(config config.DbConfig, log *slog.Logger) (*Storage, error) {
 	const op = "storage.postgresql.New"
 	connStr := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=%s", config.DbUser, config.DbPass, config.DbName, config.SSLmode)
 	db, err := sql.Open("postgres", connStr)
@@ -23,129 +38,326 @@ func New(config config.DbConfig) (*Storage, error) {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
+	log = log.With("component", "storage")
 	if err = db.Ping(); err != nil {
-		slog.Error("couldn't ping db", err)
-	} else {
-		slog.Info("pinged db successfully")
+		_ = db.Close()
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	return &Storage{db: db}, nil
+	log.Info("pinged db successfully")
+	return &Storage{db: db, log: log, softDelete: config.SoftDelete}, nil
 }
 
 func (s *Storage) Close() error {
 	return s.db.Close()
 }
 
-func (s *Storage) Ping() error {
-	return s.db.Ping()
+// Ping -- checks if db is reachable. Is used as the readiness check.
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
 }
 
-// Delete -- deletes storage.Order from storage.
-func (s *Storage) Delete(uuid, trackNum string) error {
-	_, err := s.db.Exec(deleteItems, trackNum)
+// Delete -- deletes storage.Order from storage along with its cache backup. All the tables are cleaned up in one transaction, so
+// the order is either deleted completely or left untouched. In soft-delete mode the order is kept with deleted_at timestamp and is
+// hidden from all the reads. Returns storage.ErrOrderNotFound if there is no such order and *storage.OpError on failure.
+func (s *Storage) Delete(ctx context.Context, uuid string) (err error) {
+	const op = "storage.postgresql.Delete"
+	ctx, done := observe(ctx, "delete", attribute.String("order_uid", uuid))
+	defer func() { done(err) }()
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		slog.Error("couldn't delete order", err)
-		return err
+		return &storage.OpError{Op: op, Stage: storage.StageBegin, Err: err}
 	}
+	defer s.rollback(ctx, tx)
 
-	_, err = s.db.Exec(deleteDelivery, trackNum)
-	if err != nil {
-		slog.Error("couldn't delete order", err)
-		return err
+	var locked string
+	if err = tx.QueryRowContext(ctx, lockOrder, uuid).Scan(&locked); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%s: %s: %w", op, uuid, storage.ErrOrderNotFound)
+		}
+		return &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
 	}
 
-	_, err = s.db.Exec(deletePayment, uuid)
-	if err != nil {
-		slog.Error("couldn't delete order", err)
-		return err
+	if _, err = tx.ExecContext(ctx, deleteCache, uuid); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
 	}
 
-	_, err = s.db.Exec(deleteOrder, uuid)
-	if err != nil {
-		slog.Error("couldn't delete order", err)
-		return err
+	if s.softDelete {
+		if _, err = tx.ExecContext(ctx, softDeleteOrder, uuid); err != nil {
+			return &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+		}
+		if err = tx.Commit(); err != nil {
+			return &storage.OpError{Op: op, Stage: storage.StageCommit, Err: err}
+		}
+		return nil
+	}
+
+	if _, err = tx.ExecContext(ctx, deleteItems, uuid); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageItems, Err: err}
+	}
+
+	if _, err = tx.ExecContext(ctx, deleteDelivery, uuid); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageDelivery, Err: err}
+	}
+
+	if _, err = tx.ExecContext(ctx, deletePayment, uuid); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StagePayment, Err: err}
+	}
+
+	if _, err = tx.ExecContext(ctx, deleteEvents, uuid); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageEvents, Err: err}
+	}
+
+	if _, err = tx.ExecContext(ctx, deleteOrder, uuid); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageCommit, Err: err}
 	}
 
 	return nil
 }
 
-// GetOrder -- sends storage.Order by given uid if exists.
-func (s *Storage) GetOrder(orderUid string) (*storage.Order, error) {
-	const op = "storage.postrgesql.getOrder"
-	result := s.db.QueryRow(getOrderTemplate, orderUid)
+// GetOrder -- sends storage.Order by given uid if exists, otherwise returns storage.ErrOrderNotFound.
+func (s *Storage) GetOrder(ctx context.Context, orderUid string) (_ *storage.Order, err error) {
+	const op = "storage.postgresql.GetOrder"
+	ctx, done := observe(ctx, "get_order", attribute.String("order_uid", orderUid))
+	defer func() { done(err) }()
+	result := s.db.QueryRowContext(ctx, getOrderTemplate, orderUid)
 
 	order, err := ParseOrder(result)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %s: %w", op, orderUid, storage.ErrOrderNotFound)
+	}
 	if err != nil {
-		slog.Error(op, "Couldn't get order: ", err)
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	res, err := s.db.Query(getItemsTemplate, order.TrackNum)
+	res, err := s.db.QueryContext(ctx, getItemsTemplate, order.OrderID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: items: %w", op, err)
+	}
+	defer s.closeRows(ctx, res)
 
-	order.Items = *ParseItems(res)
+	items, err := ParseItems(res)
 	if err != nil {
-		slog.Error(op, "Couldn't get items: ", err)
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
+	order.Items = *items
 
 	return order, nil
 }
 
-// SaveOrder -- saves the given order to the storage.
-func (s *Storage) SaveOrder(order *storage.Order) error {
+// GetOrders -- returns orders by their uids with their items in two queries. Missing orders are skipped, the result isn't ordered.
+func (s *Storage) GetOrders(ctx context.Context, uuids []string) (_ []storage.Order, err error) {
+	const op = "storage.postgresql.GetOrders"
+	ctx, done := observe(ctx, "get_orders", attribute.Int("orders", len(uuids)))
+	defer func() { done(err) }()
+
+	rows, err := s.db.QueryContext(ctx, getOrdersTemplate, pq.Array(uuids))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer s.closeRows(ctx, rows)
+
+	orders := make([]storage.Order, 0, len(uuids))
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		orders = append(orders, *order)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err = s.attachItems(ctx, orders); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return orders, nil
+}
+
+// OrderVersions -- returns the current versions of the orders by their uuids. Deleted and missing orders aren't in the result.
+func (s *Storage) OrderVersions(ctx context.Context, uuids []string) (_ map[string]int64, err error) {
+	const op = "storage.postgresql.OrderVersions"
+	ctx, done := observe(ctx, "order_versions", attribute.Int("orders", len(uuids)))
+	defer func() { done(err) }()
+
+	rows, err := s.db.QueryContext(ctx, getVersions, pq.Array(uuids))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer s.closeRows(ctx, rows)
+
+	versions := make(map[string]int64, len(uuids))
+	for rows.Next() {
+		var uuid string
+		var version int64
+		if err = rows.Scan(&uuid, &version); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		versions[uuid] = version
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return versions, nil
+}
+
+// SaveOrder -- saves the given order to the storage. The order, its delivery, payment and items are written in one transaction:
+// either everything is committed or nothing is. Returns *storage.OpError on failure. Saving an order which already exists is
+// reported with storage.ErrDuplicateOrder or storage.ErrOrderConflict, depending on whether its content has changed.
+func (s *Storage) SaveOrder(ctx context.Context, order *storage.Order) (err error) {
 	const op = "storage.postgresql.SaveOrder"
+	ctx, done := observe(ctx, "save_order", attribute.String("order_uid", order.OrderID))
+	defer func() { done(err) }()
 
-	_, err := s.db.Exec(saveOrder,
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageBegin, Err: err}
+	}
+	defer s.rollback(ctx, tx)
+
+	// date_created is timestamp without time zone, which drops the offset, so the time is written in UTC to be read back equal
+	res, err := tx.ExecContext(ctx, saveOrder,
 		order.OrderID, order.TrackNum, order.Entry, order.Locale,
 		order.InternalSignature, order.CustomerId, order.DeliveryService,
-		order.Shardkey, order.SmId, order.DateCreated, order.OofShard,
+		order.Shardkey, order.SmId, order.DateCreated.UTC(), order.OofShard, storage.StatusCreated,
 	)
 	if err != nil {
-		return fmt.Errorf("%s: order: %w", op, err)
+		return &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+	if inserted, err := res.RowsAffected(); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	} else if inserted == 0 {
+		return s.compareExisting(ctx, order)
 	}
 
-	_, err = s.db.Exec(saveDelivery,
-		order.TrackNum, order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip,
+	_, err = tx.ExecContext(ctx, saveDelivery,
+		order.OrderID, order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip,
 		order.Delivery.City, order.Delivery.Address, order.Delivery.Region,
 		order.Delivery.Email,
 	)
 	if err != nil {
-		return fmt.Errorf("%s: delivery: %w", op, err)
+		return &storage.OpError{Op: op, Stage: storage.StageDelivery, Err: err}
 	}
 
-	_, err = s.db.Exec(savePayment,
+	_, err = tx.ExecContext(ctx, savePayment,
 		order.Payment.Transaction, order.Payment.ReqID, order.Payment.Currency,
 		order.Payment.Provider, order.Payment.Amount, order.Payment.PaymentDt,
 		order.Payment.Bank, order.Payment.DeliveryCost, order.Payment.GoodsTotal,
 		order.Payment.CustomFee,
 	)
 	if err != nil {
-		return fmt.Errorf("%s: payment: %w", op, err)
+		return &storage.OpError{Op: op, Stage: storage.StagePayment, Err: err}
+	}
+
+	if err = insertItems(ctx, tx, order); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageItems, Err: err}
+	}
+
+	if _, err = tx.ExecContext(ctx, saveEvent, order.OrderID, nil, storage.StatusCreated, ""); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageEvents, Err: err}
 	}
 
+	if err = tx.Commit(); err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageCommit, Err: err}
+	}
+
+	return nil
+}
+
+// insertItems -- inserts the items of the order numbered by their position.
+func insertItems(ctx context.Context, tx *sql.Tx, order *storage.Order) error {
 	for i := 0; i < len(order.Items); i++ {
-		_, err = s.db.Exec(saveItems,
-			order.Items[i].ChrtID, order.Items[i].TrackNumber, order.Items[i].Price,
+		_, err := tx.ExecContext(ctx, saveItems,
+			order.OrderID, i, order.Items[i].ChrtID, order.Items[i].TrackNumber, order.Items[i].Price,
 			order.Items[i].Rid, order.Items[i].Name, order.Items[i].Sale, order.Items[i].Size,
 			order.Items[i].TotalPrice, order.Items[i].NmID, order.Items[i].Brand,
 			order.Items[i].Status,
 		)
 		if err != nil {
-			return fmt.Errorf("%s: items: %w", op, err)
+			return err
 		}
 	}
-
 	return nil
+}
+
+// compareExisting -- is called when the order with the same order_uid has already been saved. Returns storage.ErrDuplicateOrder if
+// the saved order is identical to the given one and storage.ErrOrderConflict otherwise, soft-deleted orders always conflict.
+func (s *Storage) compareExisting(ctx context.Context, order *storage.Order) error {
+	const op = "storage.postgresql.SaveOrder"
+
+	existing, err := s.GetOrder(ctx, order.OrderID)
+	if errors.Is(err, storage.ErrOrderNotFound) && s.isDeleted(ctx, order.OrderID) {
+		return fmt.Errorf("%s: %s has been deleted: %w", op, order.OrderID, storage.ErrOrderConflict)
+	}
+	if err != nil {
+		return &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+
+	if existing.Equal(order) {
+		return fmt.Errorf("%s: %s: %w", op, order.OrderID, storage.ErrDuplicateOrder)
+	}
+	return fmt.Errorf("%s: %s: %w", op, order.OrderID, storage.ErrOrderConflict)
+}
+
+// isDeleted -- tells a soft-deleted order apart from a missing one.
+func (s *Storage) isDeleted(ctx context.Context, uuid string) bool {
+	var deleted bool
+	if err := s.db.QueryRowContext(ctx, isDeleted, uuid).Scan(&deleted); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		s.log.ErrorContext(ctx, "couldn't check if order is deleted", "order_uid", uuid, logger.Err(err))
+	}
+	return deleted
+}
 
+// observe -- starts the span of the storage operation. Returns the func which must be called with the operation's error to end
+// the span and record the operation metrics.
+func observe(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "postgresql."+operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, attribute.String("db.system", "postgresql"))...))
+
+	return ctx, func(err error) {
+		metrics.ObserveStorage(operation, start, err)
+		if err != nil && !errors.Is(err, storage.ErrOrderNotFound) && !errors.Is(err, storage.ErrSnapshotNotFound) &&
+			!errors.Is(err, storage.ErrIllegalTransition) && !errors.Is(err, storage.ErrVersionMismatch) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// rollback -- rolls tx back unless it has already been committed.
+func (s *Storage) rollback(ctx context.Context, tx *sql.Tx) {
+	if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		s.log.ErrorContext(ctx, "couldn't rollback transaction", logger.Err(err))
+	}
+}
+
+// closeRows -- closes rows logging the error if any.
+func (s *Storage) closeRows(ctx context.Context, rows *sql.Rows) {
+	if err := rows.Close(); err != nil {
+		s.log.ErrorContext(ctx, "couldn't close rows", logger.Err(err))
+	}
 }
 
 // ParseOrder -- parses sql.Row to storage.Order.
 func ParseOrder(row *sql.Row) (*storage.Order, error) {
+	return scanOrder(row)
+}
+
+// scanOrder -- scans storage.Order from the sql.Row or sql.Rows selected by selectOrders.
+func scanOrder(row interface{ Scan(dest ...any) error }) (*storage.Order, error) {
 	var order storage.Order
 	err := row.Scan( // Common order Info
 		&order.OrderID, &order.TrackNum, &order.Entry,
 		&order.Locale, &order.InternalSignature,
 		&order.CustomerId, &order.DeliveryService,
-		&order.Shardkey, &order.SmId, &order.DateCreated, &order.OofShard,
+		&order.Shardkey, &order.SmId, &order.DateCreated, &order.OofShard, &order.Status, &order.Version,
 		//Delivery
 		&order.Delivery.Name, &order.Delivery.Phone, &order.Delivery.Zip,
 		&order.Delivery.City, &order.Delivery.Address, &order.Delivery.Region,
@@ -166,30 +378,163 @@ func ParseOrder(row *sql.Row) (*storage.Order, error) {
 }
 
 // ParseItems -- parses sql.Row from storage to []storage.Item.
-func ParseItems(row *sql.Rows) *[]storage.Item {
-	var items []storage.Item = make([]storage.Item, 0)
+func ParseItems(row *sql.Rows) (*[]storage.Item, error) {
+	_, items, err := scanItems(row)
+	if err != nil {
+		return nil, err
+	}
+	return &items, nil
+}
+
+// scanItems -- scans the items selected by selectItems along with the order_uid of every item.
+func scanItems(row *sql.Rows) ([]string, []storage.Item, error) {
+	uuids := make([]string, 0)
+	items := make([]storage.Item, 0)
 
 	for row.Next() {
+		var uuid string
 		var item storage.Item
-		err := row.Scan(&item.ChrtID, &item.TrackNumber, &item.Price,
+		err := row.Scan(&uuid, &item.ChrtID, &item.TrackNumber, &item.Price,
 			&item.Rid, &item.Name, &item.Sale, &item.Size,
 			&item.TotalPrice, &item.NmID, &item.Brand,
 			&item.Status)
 		if err != nil {
-			slog.Error("Error parsing item:", err)
-			return nil
+			return nil, nil, fmt.Errorf("error parsing item: %w", err)
 		}
+		uuids = append(uuids, uuid)
 		items = append(items, item)
 	}
 
-	return &items
+	return uuids, items, row.Err()
+}
+
+// ListOrders -- lists orders matching the filter from the newest by date_created. Returns the page and the cursor of the next
+// page, which is empty if there are no more orders.
+func (s *Storage) ListOrders(ctx context.Context, filter storage.OrderFilter) (_ []storage.Order, _ string, err error) {
+	const op = "storage.postgresql.ListOrders"
+	ctx, done := observe(ctx, "list_orders")
+	defer func() { done(err) }()
+
+	var conds []string
+	var args []any
+	where := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.CustomerID != "" {
+		where("o.customer_id = $%d", filter.CustomerID)
+	}
+	if filter.TrackNumber != "" {
+		where("o.track_number = $%d", filter.TrackNumber)
+	}
+	if filter.DeliveryService != "" {
+		where("o.delivery_service = $%d", filter.DeliveryService)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		where("o.date_created >= $%d", filter.CreatedFrom.UTC())
+	}
+	if !filter.CreatedTo.IsZero() {
+		where("o.date_created < $%d", filter.CreatedTo.UTC())
+	}
+	if filter.Bank != "" {
+		where("pa.bank = $%d", filter.Bank)
+	}
+	if filter.Currency != "" {
+		where("pa.currency = $%d", filter.Currency)
+	}
+	if filter.Brand != "" {
+		where("EXISTS (SELECT 1 FROM items i WHERE i.order_uid = o.order_uid AND i.brand = $%d)", filter.Brand)
+	}
+	if filter.Cursor != "" {
+		cursor, err := storage.DecodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", op, err)
+		}
+		args = append(args, cursor.DateCreated.UTC(), cursor.OrderID)
+		conds = append(conds, fmt.Sprintf("(o.date_created, o.order_uid) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	limit := filter.Limit
+	if limit <= 0 || limit > storage.MaxListLimit {
+		limit = storage.DefaultListLimit
+	}
+
+	query := selectOrders + liveOrders
+	if len(conds) != 0 {
+		query += " AND " + strings.Join(conds, " AND ")
+	}
+	// one extra order tells if there is the next page
+	query += listOrdersOrder + strconv.Itoa(limit+1)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+	defer s.closeRows(ctx, rows)
+
+	orders := make([]storage.Order, 0, limit+1)
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", op, err)
+		}
+		orders = append(orders, *order)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	var next string
+	if len(orders) > limit {
+		orders = orders[:limit]
+		last := orders[limit-1]
+		next = storage.Cursor{DateCreated: last.DateCreated, OrderID: last.OrderID}.Encode()
+	}
+
+	if err = s.attachItems(ctx, orders); err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+	return orders, next, nil
+}
+
+// attachItems -- loads items of all the orders in one query, keeping their order.
+func (s *Storage) attachItems(ctx context.Context, orders []storage.Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	uuids := make([]string, len(orders))
+	for i := range orders {
+		uuids[i] = orders[i].OrderID
+	}
+
+	rows, err := s.db.QueryContext(ctx, listItemsTemplate, pq.Array(uuids))
+	if err != nil {
+		return fmt.Errorf("items: %w", err)
+	}
+	defer s.closeRows(ctx, rows)
+
+	owners, items, err := scanItems(rows)
+	if err != nil {
+		return err
+	}
+
+	byOrder := make(map[string][]storage.Item, len(orders))
+	for i, item := range items {
+		byOrder[owners[i]] = append(byOrder[owners[i]], item)
+	}
+	for i := range orders {
+		orders[i].Items = byOrder[orders[i].OrderID]
+	}
+	return nil
 }
 
 // DeleteCache -- deletes cached uuid from storage.
 func (s *Storage) DeleteCache(uuid string) error {
 	_, err := s.db.Exec(deleteCache, uuid)
 	if err != nil {
-		slog.Error("couldn't delete from cached: ", err)
+		s.log.Error("couldn't delete from cached", "order_uid", uuid, logger.Err(err))
 	}
 	return err
 }
@@ -198,7 +543,6 @@ func (s *Storage) DeleteCache(uuid string) error {
 func (s *Storage) SaveCache(uuid string) error {
 	_, err := s.db.Exec(saveCache, uuid)
 	if err != nil {
-		//slog.Error("couldn't save cache: ", err)
 		return err
 	}
 	return nil
@@ -211,45 +555,73 @@ func (s *Storage) IsAlreadyCached(uuid string) bool {
 		if errors.Is(err, sql.ErrNoRows) {
 			return false
 		}
-		slog.Error("couldn't check if order is cached")
+		s.log.Error("couldn't check if order is cached", "order_uid", uuid, logger.Err(err))
 		return false
 	}
 	return true
 }
 
-// RestoreCache -- returns []storage.Order by backupED uuids in the storage.
+// restoreBatch -- is the number of backed up orders loaded by one GetOrders call.
+const restoreBatch = 500
+
+// RestoreCache -- returns []storage.Order by backupED uuids in the storage. Orders are loaded in batches of restoreBatch.
 func (s *Storage) RestoreCache() (*[]storage.Order, error) {
-	rows, err := s.db.Query(getCache)
+	const op = "storage.postgresql.RestoreCache"
+	ctx := context.Background()
+
+	rows, err := s.db.QueryContext(ctx, getCache)
 	if err != nil {
-		slog.Error("couldn't query restoring cache: ", err)
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-			slog.Error("couldn't close rows")
-		}
-	}(rows)
-	uuids := make([]string, 0)
+	defer s.closeRows(ctx, rows)
 
+	uuids := make([]string, 0)
 	for rows.Next() {
 		var tmp string
-		err = rows.Scan(&tmp)
-		if err != nil {
-			slog.Error("couldn't get all the uuids from cache: ", err)
-			continue
+		if err = rows.Scan(&tmp); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
 		}
 		uuids = append(uuids, tmp)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
 
-	orders := make([]storage.Order, 0)
-	for _, value := range uuids {
-		order, err := s.GetOrder(value)
+	orders := make([]storage.Order, 0, len(uuids))
+	for start := 0; start < len(uuids); start += restoreBatch {
+		batch, err := s.GetOrders(ctx, uuids[start:min(start+restoreBatch, len(uuids))])
 		if err != nil {
-			slog.Error("couldn't get order: ", value, err)
-			break
+			return nil, fmt.Errorf("%s: %w", op, err)
 		}
-		orders = append(orders, *order)
+		orders = append(orders, batch...)
+	}
+	return &orders, nil
+}
+
+// SaveSnapshot -- replaces the cache snapshot with data. The snapshot is kept in a single row, so it's replaced atomically.
+func (s *Storage) SaveSnapshot(data []byte) (err error) {
+	const op = "storage.postgresql.SaveSnapshot"
+	ctx, done := observe(context.Background(), "save_snapshot", attribute.Int("bytes", len(data)))
+	defer func() { done(err) }()
+
+	if _, err = s.db.ExecContext(ctx, saveSnapshot, data); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// LoadSnapshot -- returns the last saved cache snapshot, storage.ErrSnapshotNotFound if there is none.
+func (s *Storage) LoadSnapshot() (_ []byte, err error) {
+	const op = "storage.postgresql.LoadSnapshot"
+	ctx, done := observe(context.Background(), "load_snapshot")
+	defer func() { done(err) }()
+
+	var data []byte
+	if err = s.db.QueryRowContext(ctx, loadSnapshot).Scan(&data); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrSnapshotNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	return &orders, err
+	return data, nil
 }
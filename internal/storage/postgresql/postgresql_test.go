@@ -0,0 +1,87 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// utcArg -- matches the time written in UTC, as timestamp columns drop the offset.
+type utcArg struct {
+	want time.Time
+}
+
+func (a utcArg) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	return ok && t.Location() == time.UTC && t.Equal(a.want)
+}
+
+func TestSaveOrderWritesUTC(t *testing.T) {
+	s, mock := newMockStorage(t)
+	order := storage.RandomOrder("b563feb7b2b84b6test")
+	order.DateCreated = time.Date(2021, 11, 26, 9, 22, 19, 0, time.FixedZone("MSK", 3*60*60))
+
+	errStop := errors.New("stop")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(saveOrder)).WithArgs(
+		order.OrderID, order.TrackNum, order.Entry, order.Locale, order.InternalSignature, order.CustomerId,
+		order.DeliveryService, order.Shardkey, int64(order.SmId), utcArg{order.DateCreated}, order.OofShard,
+		string(storage.StatusCreated),
+	).WillReturnError(errStop)
+	mock.ExpectRollback()
+
+	if err := s.SaveOrder(context.Background(), order); !errors.Is(err, errStop) {
+		t.Fatalf("SaveOrder() = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveOrderItemsFailureRollsBack(t *testing.T) {
+	s, mock := newMockStorage(t)
+	order := storage.RandomOrder("b563feb7b2b84b6test")
+
+	errItems := errors.New("items")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(saveOrder)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(saveDelivery)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(savePayment)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(saveItems)).WillReturnError(errItems)
+	mock.ExpectRollback()
+
+	err := s.SaveOrder(context.Background(), order)
+	var opErr *storage.OpError
+	if !errors.As(err, &opErr) || opErr.Stage != storage.StageItems || !errors.Is(err, errItems) {
+		t.Fatalf("SaveOrder() = %v, want items stage error", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteItemsFailureRollsBack(t *testing.T) {
+	s, mock := newMockStorage(t)
+	const uuid = "b563feb7b2b84b6test"
+
+	errItems := errors.New("items")
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(lockOrder)).WithArgs(uuid).WillReturnRows(sqlmock.NewRows([]string{"order_uid"}).AddRow(uuid))
+	mock.ExpectExec(regexp.QuoteMeta(deleteCache)).WithArgs(uuid).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(deleteItems)).WithArgs(uuid).WillReturnError(errItems)
+	mock.ExpectRollback()
+
+	err := s.Delete(context.Background(), uuid)
+	var opErr *storage.OpError
+	if !errors.As(err, &opErr) || opErr.Stage != storage.StageItems || !errors.Is(err, errItems) {
+		t.Fatalf("Delete() = %v, want items stage error", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// UpdateStatus -- moves the order to the status to and records the transition in order_events in one transaction. Returns
+// storage.ErrOrderNotFound if there is no such order and storage.ErrIllegalTransition if the order can't move to the status.
+func (s *Storage) UpdateStatus(ctx context.Context, uuid string, to storage.Status, reason string) (_ *storage.OrderEvent, err error) {
+	const op = "storage.postgresql.UpdateStatus"
+	ctx, done := observe(ctx, "update_status", attribute.String("order_uid", uuid), attribute.String("status", string(to)))
+	defer func() { done(err) }()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageBegin, Err: err}
+	}
+	defer s.rollback(ctx, tx)
+
+	var from storage.Status
+	if err = tx.QueryRowContext(ctx, lockStatus, uuid).Scan(&from); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%s: %s: %w", op, uuid, storage.ErrOrderNotFound)
+		}
+		return nil, &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+	if err = from.Transition(to); err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", op, uuid, err)
+	}
+
+	if _, err = tx.ExecContext(ctx, updateStatus, uuid, to); err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+
+	event := storage.OrderEvent{OrderID: uuid, From: from, To: to, Reason: reason}
+	if err = tx.QueryRowContext(ctx, saveEvent, uuid, from, to, reason).Scan(&event.ID, &event.CreatedAt); err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageEvents, Err: err}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageCommit, Err: err}
+	}
+	return &event, nil
+}
+
+// OrderEvents -- returns the status history of the order from its creation. Returns storage.ErrOrderNotFound if the order has
+// no events.
+func (s *Storage) OrderEvents(ctx context.Context, uuid string) (_ []storage.OrderEvent, err error) {
+	const op = "storage.postgresql.OrderEvents"
+	ctx, done := observe(ctx, "order_events", attribute.String("order_uid", uuid))
+	defer func() { done(err) }()
+
+	rows, err := s.db.QueryContext(ctx, getEvents, uuid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer s.closeRows(ctx, rows)
+
+	events := make([]storage.OrderEvent, 0)
+	for rows.Next() {
+		var event storage.OrderEvent
+		if err = rows.Scan(&event.ID, &event.OrderID, &event.From, &event.To, &event.Reason, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("%s: %s: %w", op, uuid, storage.ErrOrderNotFound)
+	}
+	return events, nil
+}
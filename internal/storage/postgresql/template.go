@@ -1,19 +1,33 @@
 package postgresql
 
 const (
-	getOrderTemplate = `
+	selectOrders = `
 SELECT o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature, 
 	o.customer_id, o.delivery_service, o.shardkey, o.sm_id, 
-		o.date_created, o.oof_shard, 
+		o.date_created, o.oof_shard, o.status, o.version,
 	d.fio, d.phone, d.zip, d.city, d.address, d.region, d.email,
 	pa.request_id, pa.currency, pa.provider, pa.amount, pa.payment_dt, pa.bank,
 		pa.delivery_cost, pa.goods_total, pa.custom_fee
 FROM orders o  
-JOIN delivery d ON o.track_number = d.track_number
+JOIN delivery d ON o.order_uid = d.order_uid
 JOIN payment pa ON o.order_uid = pa.transact
-WHERE o.order_uid = $1
 `
-	getItemsTemplate = `SELECT * FROM items WHERE track_number = $1`
+	// liveOrders -- excludes soft-deleted orders, every query by selectOrders starts with it
+	liveOrders        = `WHERE o.deleted_at IS NULL`
+	getOrderTemplate  = selectOrders + liveOrders + ` AND o.order_uid = $1`
+	getOrdersTemplate = selectOrders + liveOrders + ` AND o.order_uid = ANY($1)`
+	getItemsTemplate  = selectItems + `WHERE order_uid = $1 ORDER BY line`
+	getVersions       = `SELECT order_uid, version FROM orders WHERE deleted_at IS NULL AND order_uid = ANY($1)`
+
+	// listOrdersOrder -- keyset pagination order, backed by orders_date_created_idx
+	listOrdersOrder   = ` ORDER BY o.date_created DESC, o.order_uid DESC LIMIT `
+	listItemsTemplate = selectItems + `WHERE order_uid = ANY($1) ORDER BY order_uid, line`
+
+	// selectItems -- lists the columns in the order scanned by scanItems
+	selectItems = `
+SELECT order_uid, chrt_id, track_number, price, rid, iname, sale, isize, total_price, nm_id, brand, status
+FROM items
+`
 
 	saveOrder = `
 INSERT INTO orders(
@@ -27,7 +41,8 @@ INSERT INTO orders(
 	shardkey,
 	sm_id,
 	date_created,
-	oof_shard
+	oof_shard,
+	status
 )
 VALUES (
 	$1,
@@ -40,12 +55,14 @@ VALUES (
 	$8,
 	$9,
 	$10,
-	$11
-);`
+	$11,
+	$12
+)
+ON CONFLICT (order_uid) DO NOTHING;`
 
 	saveDelivery = `
 INSERT INTO delivery(
-	track_number,
+	order_uid,
     fio,
 	phone,
 	zip,
@@ -67,7 +84,19 @@ VALUES (
 `
 
 	savePayment = `
-INSERT INTO payment VALUES (
+INSERT INTO payment(
+	transact,
+	request_id,
+	currency,
+	provider,
+	amount,
+	payment_dt,
+	bank,
+	delivery_cost,
+	goods_total,
+	custom_fee
+)
+VALUES (
 	$1,
 	$2,
 	$3,
@@ -82,7 +111,22 @@ INSERT INTO payment VALUES (
 `
 
 	saveItems = `
-INSERT INTO items VALUES (
+INSERT INTO items(
+	order_uid,
+	line,
+	chrt_id,
+	track_number,
+	price,
+	rid,
+	iname,
+	sale,
+	isize,
+	total_price,
+	nm_id,
+	brand,
+	status
+)
+VALUES (
 	$1,
 	$2,
 	$3,
@@ -93,27 +137,139 @@ INSERT INTO items VALUES (
 	$8,
 	$9,
 	$10,
-	$11
+	$11,
+	$12,
+	$13
 );
 `
 
+	lockOrder = `
+SELECT order_uid FROM orders WHERE order_uid = $1 AND deleted_at IS NULL FOR UPDATE;
+`
 	deletePayment = `
 DELETE FROM payment WHERE transact = $1;
 `
 	deleteItems = ` 
-DELETE FROM items WHERE track_number = $1;
+DELETE FROM items WHERE order_uid = $1;
 `
 	deleteDelivery = `
-DELETE FROM delivery WHERE track_number = $1;
+DELETE FROM delivery WHERE order_uid = $1;
+`
+	deleteEvents = `
+DELETE FROM order_events WHERE order_uid = $1;
 `
 	deleteOrder = `
 DELETE FROM orders WHERE order_uid = $1;
+`
+	softDeleteOrder = `
+UPDATE orders SET deleted_at = now(), version = version + 1 WHERE order_uid = $1;
+`
+	isDeleted = `SELECT deleted_at IS NOT NULL FROM orders WHERE order_uid = $1`
+
+	lockStatus   = `SELECT status FROM orders WHERE order_uid = $1 AND deleted_at IS NULL FOR UPDATE`
+	updateStatus = `UPDATE orders SET status = $2, version = version + 1 WHERE order_uid = $1`
+	saveEvent    = `
+INSERT INTO order_events (order_uid, from_status, to_status, reason) VALUES ($1, $2, $3, $4)
+RETURNING id, created_at
+`
+	getEvents = `
+SELECT e.id, e.order_uid, COALESCE(e.from_status, ''), e.to_status, e.reason, e.created_at
+FROM order_events e JOIN orders o ON o.order_uid = e.order_uid
+WHERE e.order_uid = $1 AND o.deleted_at IS NULL ORDER BY e.id
+`
+
+	lockVersion = `SELECT version FROM orders WHERE order_uid = $1 AND deleted_at IS NULL FOR UPDATE`
+	updateOrder = `
+UPDATE orders SET track_number = $2, entry = $3, locale = $4, internal_signature = $5, customer_id = $6, delivery_service = $7,
+	shardkey = $8, sm_id = $9, date_created = $10, oof_shard = $11, version = version + 1
+WHERE order_uid = $1
+RETURNING status, version
+`
+	updateDelivery = `
+UPDATE delivery SET fio = $2, phone = $3, zip = $4, city = $5, address = $6, region = $7, email = $8
+WHERE order_uid = $1
+`
+	updatePayment = `
+UPDATE payment SET request_id = $2, currency = $3, provider = $4, amount = $5, payment_dt = $6, bank = $7, delivery_cost = $8,
+	goods_total = $9, custom_fee = $10
+WHERE transact = $1
+`
+
+	// lockExpired -- picks the batch of orders to archive, skipping the ones being changed, so several instances may archive at once
+	// restored orders are kept for the retention period since they have been restored
+	lockExpired = `
+SELECT order_uid, deleted_at FROM orders
+WHERE date_created < $1 AND (restored_at IS NULL OR restored_at < $1)
+ORDER BY date_created, order_uid LIMIT $2
+FOR UPDATE SKIP LOCKED
+`
+	// getExpiredTemplate -- selects soft-deleted orders as well, and the ones missing delivery or payment, which are left by old
+	// versions writing them outside of a transaction. Columns are in the order scanned by scanArchived.
+	getExpiredTemplate = `
+SELECT o.order_uid, COALESCE(o.track_number, ''), COALESCE(o.entry, ''), COALESCE(o.locale, ''),
+	COALESCE(o.internal_signature, ''), COALESCE(o.customer_id, ''), COALESCE(o.delivery_service, ''),
+	COALESCE(o.shardkey, ''), COALESCE(o.sm_id, 0), o.date_created, COALESCE(o.oof_shard, ''), o.status, o.version,
+	d.order_uid IS NOT NULL, COALESCE(d.fio, ''), COALESCE(d.phone, ''), COALESCE(d.zip, ''), COALESCE(d.city, ''),
+	COALESCE(d.address, ''), COALESCE(d.region, ''), COALESCE(d.email, ''),
+	pa.transact IS NOT NULL, COALESCE(pa.request_id, ''), COALESCE(pa.currency, ''), COALESCE(pa.provider, ''),
+	COALESCE(pa.amount, 0), COALESCE(pa.payment_dt, 0), COALESCE(pa.bank, ''), COALESCE(pa.delivery_cost, 0),
+	COALESCE(pa.goods_total, 0), COALESCE(pa.custom_fee, 0)
+FROM orders o
+LEFT JOIN delivery d ON o.order_uid = d.order_uid
+LEFT JOIN payment pa ON o.order_uid = pa.transact
+WHERE o.order_uid = ANY($1)
+`
+	listEvents = `
+SELECT id, order_uid, COALESCE(from_status, ''), to_status, reason, created_at
+FROM order_events WHERE order_uid = ANY($1) ORDER BY order_uid, id
+`
+	archiveOrder = `
+INSERT INTO order_archive (order_uid, date_created, data) VALUES ($1, $2, $3)
+ON CONFLICT (order_uid) DO UPDATE SET date_created = EXCLUDED.date_created, archived_at = now(), data = EXCLUDED.data
+`
+	purgeItems    = `DELETE FROM items WHERE order_uid = ANY($1)`
+	purgeDelivery = `DELETE FROM delivery WHERE order_uid = ANY($1)`
+	purgePayment  = `DELETE FROM payment WHERE transact = ANY($1)`
+	purgeEvents   = `DELETE FROM order_events WHERE order_uid = ANY($1)`
+	purgeCache    = `DELETE FROM cached WHERE order_uid = ANY($1)`
+	purgeOrders   = `DELETE FROM orders WHERE order_uid = ANY($1)`
+
+	getArchived    = `SELECT data FROM order_archive WHERE order_uid = $1 FOR UPDATE`
+	deleteArchived = `DELETE FROM order_archive WHERE order_uid = $1`
+	restoreOrder   = `
+INSERT INTO orders (order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service, shardkey, sm_id,
+	date_created, oof_shard, status, version, deleted_at, restored_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, now())
+ON CONFLICT (order_uid) DO NOTHING
+`
+	restoreEvent = `
+INSERT INTO order_events (id, order_uid, from_status, to_status, reason, created_at) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)
 `
 
 	deleteCache = `
 DELETE FROM cached WHERE order_uid = $1
 `
-	saveCache       = `INSERT INTO cached VALUES($1)`
-	getCache        = `SELECT * FROM cached`
-	isAlreadyCached = `SELECT * FROM cached WHERE order_uid = $1`
+	saveCache       = `INSERT INTO cached (order_uid) VALUES($1)`
+	getCache        = `SELECT order_uid FROM cached`
+	isAlreadyCached = `SELECT order_uid FROM cached WHERE order_uid = $1`
+
+	saveSnapshot = `
+INSERT INTO cache_snapshot (id, data, created_at) VALUES (1, $1, now())
+ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, created_at = EXCLUDED.created_at
+`
+	loadSnapshot = `SELECT data FROM cache_snapshot WHERE id = 1`
+
+	createMigrations = `
+CREATE TABLE IF NOT EXISTS schema_migrations(
+	version BIGINT PRIMARY KEY,
+	name VARCHAR(128) NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT now()
+)
+`
+	appliedMigrations = `SELECT version FROM schema_migrations`
+	schemaVersion     = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`
+	insertMigration   = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+	deleteMigration   = `DELETE FROM schema_migrations WHERE version = $1`
+	lockMigrations    = `SELECT pg_advisory_lock($1)`
+	unlockMigrations  = `SELECT pg_advisory_unlock($1)`
 )
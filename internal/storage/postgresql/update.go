@@ -0,0 +1,78 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/wlcmtunknwndth/L0_WB/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// UpdateOrder -- replaces the order, its delivery, payment and items in one transaction, if the stored order is still of the given
+// version. Status is changed by UpdateStatus only and is left untouched. Returns the stored order with its new version,
+// storage.ErrOrderNotFound if there is no such order and storage.ErrVersionMismatch if it has been modified since version.
+func (s *Storage) UpdateOrder(ctx context.Context, order *storage.Order, version int64) (_ *storage.Order, err error) {
+	const op = "storage.postgresql.UpdateOrder"
+	ctx, done := observe(ctx, "update_order", attribute.String("order_uid", order.OrderID))
+	defer func() { done(err) }()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageBegin, Err: err}
+	}
+	defer s.rollback(ctx, tx)
+
+	var current int64
+	if err = tx.QueryRowContext(ctx, lockVersion, order.OrderID).Scan(&current); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%s: %s: %w", op, order.OrderID, storage.ErrOrderNotFound)
+		}
+		return nil, &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+	if current != version {
+		return nil, fmt.Errorf("%s: %s: version %d, not %d: %w", op, order.OrderID, current, version, storage.ErrVersionMismatch)
+	}
+
+	updated := *order
+	updated.Payment.Transaction, updated.DateCreated = order.OrderID, order.DateCreated.UTC()
+	err = tx.QueryRowContext(ctx, updateOrder,
+		order.OrderID, order.TrackNum, order.Entry, order.Locale,
+		order.InternalSignature, order.CustomerId, order.DeliveryService,
+		order.Shardkey, order.SmId, order.DateCreated.UTC(), order.OofShard,
+	).Scan(&updated.Status, &updated.Version)
+	if err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageOrder, Err: err}
+	}
+
+	_, err = tx.ExecContext(ctx, updateDelivery,
+		order.OrderID, order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip,
+		order.Delivery.City, order.Delivery.Address, order.Delivery.Region,
+		order.Delivery.Email,
+	)
+	if err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageDelivery, Err: err}
+	}
+
+	_, err = tx.ExecContext(ctx, updatePayment,
+		order.OrderID, order.Payment.ReqID, order.Payment.Currency,
+		order.Payment.Provider, order.Payment.Amount, order.Payment.PaymentDt,
+		order.Payment.Bank, order.Payment.DeliveryCost, order.Payment.GoodsTotal,
+		order.Payment.CustomFee,
+	)
+	if err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StagePayment, Err: err}
+	}
+
+	if _, err = tx.ExecContext(ctx, deleteItems, order.OrderID); err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageItems, Err: err}
+	}
+	if err = insertItems(ctx, tx, order); err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageItems, Err: err}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, &storage.OpError{Op: op, Stage: storage.StageCommit, Err: err}
+	}
+	return &updated, nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Status -- is the stage of the order lifecycle.
+type Status string
+
+const (
+	StatusCreated    Status = "created"
+	StatusPaid       Status = "paid"
+	StatusAssembling Status = "assembling"
+	StatusShipped    Status = "shipped"
+	StatusDelivered  Status = "delivered"
+	StatusCancelled  Status = "cancelled"
+	StatusReturned   Status = "returned"
+)
+
+var (
+	// ErrInvalidStatus -- there is no such status.
+	ErrInvalidStatus = errors.New("invalid order status")
+	// ErrIllegalTransition -- the order can't move from its current status to the requested one.
+	ErrIllegalTransition = errors.New("illegal order status transition")
+)
+
+// transitions -- are the statuses every status may move to. Cancelled and returned orders are final.
+var transitions = map[Status][]Status{
+	StatusCreated:    {StatusPaid, StatusCancelled},
+	StatusPaid:       {StatusAssembling, StatusCancelled},
+	StatusAssembling: {StatusShipped, StatusCancelled},
+	StatusShipped:    {StatusDelivered},
+	StatusDelivered:  {StatusReturned},
+	StatusCancelled:  nil,
+	StatusReturned:   nil,
+}
+
+// ParseStatus -- returns Status by its name, ErrInvalidStatus if there is no such status.
+func ParseStatus(name string) (Status, error) {
+	status := Status(name)
+	if _, ok := transitions[status]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrInvalidStatus, name)
+	}
+	return status, nil
+}
+
+// Next -- returns the statuses the order may move to from s.
+func (s Status) Next() []Status {
+	return transitions[s]
+}
+
+// Transition -- returns ErrIllegalTransition unless the order in status s may move to the status to.
+func (s Status) Transition(to Status) error {
+	for _, next := range transitions[s] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s -> %s", ErrIllegalTransition, s, to)
+}
+
+// OrderEvent -- is the status transition of the order. From is empty for the event of order creation.
+type OrderEvent struct {
+	ID        int64     `json:"id"`
+	OrderID   string    `json:"order_uid"`
+	From      Status    `json:"from,omitempty"`
+	To        Status    `json:"to"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+var allStatuses = []Status{
+	StatusCreated, StatusPaid, StatusAssembling, StatusShipped, StatusDelivered, StatusCancelled, StatusReturned,
+}
+
+func TestStatusTransition(t *testing.T) {
+	legal := map[[2]Status]bool{
+		{StatusCreated, StatusPaid}:         true,
+		{StatusCreated, StatusCancelled}:    true,
+		{StatusPaid, StatusAssembling}:      true,
+		{StatusPaid, StatusCancelled}:       true,
+		{StatusAssembling, StatusShipped}:   true,
+		{StatusAssembling, StatusCancelled}: true,
+		{StatusShipped, StatusDelivered}:    true,
+		{StatusDelivered, StatusReturned}:   true,
+	}
+
+	// every pair is checked, including the transitions to the same status and to an unknown one
+	for _, from := range append(allStatuses, "lost") {
+		for _, to := range append(allStatuses, "lost") {
+			err := from.Transition(to)
+			if legal[[2]Status{from, to}] {
+				if err != nil {
+					t.Errorf("%s -> %s: %v", from, to, err)
+				}
+				continue
+			}
+			if !errors.Is(err, ErrIllegalTransition) {
+				t.Errorf("%s -> %s = %v, want ErrIllegalTransition", from, to, err)
+			}
+		}
+	}
+
+	for _, from := range allStatuses {
+		var want int
+		for pair := range legal {
+			if pair[0] == from {
+				want++
+			}
+		}
+		if got := len(from.Next()); got != want {
+			t.Errorf("%s.Next() = %v, want %d statuses", from, from.Next(), want)
+		}
+	}
+}
+
+func TestStatusFinal(t *testing.T) {
+	for _, status := range []Status{StatusCancelled, StatusReturned} {
+		if next := status.Next(); len(next) != 0 {
+			t.Errorf("%s is final, but may move to %v", status, next)
+		}
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	for _, status := range allStatuses {
+		got, err := ParseStatus(string(status))
+		if err != nil || got != status {
+			t.Errorf("ParseStatus(%q) = %q, %v", status, got, err)
+		}
+	}
+	for _, name := range []string{"", "Paid", " paid", "lost"} {
+		if _, err := ParseStatus(name); !errors.Is(err, ErrInvalidStatus) {
+			t.Errorf("ParseStatus(%q) = %v, want ErrInvalidStatus", name, err)
+		}
+	}
+}
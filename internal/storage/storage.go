@@ -2,6 +2,9 @@ package storage
 
 import (
 	"github.com/brianvoe/gofakeit/v6"
+	"math"
+	"reflect"
+	"slices"
 	"time"
 )
 
@@ -20,8 +23,13 @@ type Order struct {
 	SmId              uint32    `json:"sm_id" protobuf:"sm_id"`
 	DateCreated       time.Time `json:"date_created" protobuf:"date_created"`
 	OofShard          string    `json:"oof_shard" protobuf:"oof_shard"`
+	Status            Status    `json:"status,omitempty" protobuf:"status"`
+	Version           int64     `json:"version,omitempty" protobuf:"version"`
 }
 
+// FirstVersion -- is the version of the just-saved order, it is incremented by every update.
+const FirstVersion int64 = 1
+
 type Delivery struct {
 	Name    string `json:"name"`
 	Phone   string `json:"phone"`
@@ -59,21 +67,41 @@ type Item struct {
 	Status      uint8  `json:"status"`
 }
 
+// Equal -- reports whether o and other describe the same order. Items are compared in order and DateCreated is compared with
+// microsecond precision, as it is kept in the storage. Status and Version aren't compared, as they change over order's
+// lifecycle.
+func (o *Order) Equal(other *Order) bool {
+	if o == nil || other == nil {
+		return o == other
+	}
+
+	a, b := *o, *other
+	if a.DateCreated.Sub(b.DateCreated).Abs() >= time.Microsecond {
+		return false
+	}
+	a.DateCreated, b.DateCreated = time.Time{}, time.Time{}
+	a.Items, b.Items = nil, nil
+	a.Status, b.Status = "", ""
+	a.Version, b.Version = 0, 0
+	// items are kept by their position in the order, so it matters
+	return reflect.DeepEqual(a, b) && slices.Equal(o.Items, other.Items)
+}
+
 // SearchRequest -- needed for unmarshaling to search for the storage.Order in the backend by sent uuid.
 type SearchRequest struct {
 	Uuid string `json:"order_uid"`
 }
 
 var banks = []string{"sber", "alpha", "raif", "tinkoff", "wtb", "rnkb"}
-var currency = []string{"USD", "RUB", "GBP", "EUR", "GRN", "IDK"}
+var currency = []string{"USD", "RUB", "GBP", "EUR", "UAH", "CNY"}
 
-// RandomOrder -- creates order with random fields.
+// RandomOrder -- creates valid order with random fields.
 func RandomOrder(uuid string) *Order {
 	address := gofakeit.Address()
 	//uuid := gofakeit.UUID()
 	trackNum := gofakeit.HexUint64()
 
-	return &Order{
+	order := &Order{
 		OrderID:  uuid,
 		TrackNum: trackNum,
 		Entry:    "WBIL",
@@ -92,11 +120,10 @@ func RandomOrder(uuid string) *Order {
 			Currency:     gofakeit.RandomString(currency),
 			Provider:     "wbpay",
 			Amount:       gofakeit.Uint32(),
-			PaymentDt:    gofakeit.Uint32(),
+			PaymentDt:    uint32(gofakeit.IntRange(1, math.MaxInt32)),
 			Bank:         gofakeit.RandomString(banks),
-			DeliveryCost: gofakeit.Uint16(),
-			GoodsTotal:   gofakeit.Uint32(),
-			CustomFee:    gofakeit.Uint16(),
+			DeliveryCost: uint16(gofakeit.IntRange(1, math.MaxUint16)),
+			CustomFee:    uint16(gofakeit.IntRange(0, math.MaxInt16)),
 		},
 		Items: []Item{
 			Item{
@@ -126,7 +153,7 @@ func RandomOrder(uuid string) *Order {
 				Status:      uint8(gofakeit.HTTPStatusCode()),
 			},
 		},
-		Locale:            gofakeit.Language(),
+		Locale:            gofakeit.LanguageAbbreviation(),
 		InternalSignature: "",
 		CustomerId:        gofakeit.UUID(),
 		DeliveryService:   "meest",
@@ -134,5 +161,11 @@ func RandomOrder(uuid string) *Order {
 		SmId:              gofakeit.Uint32(),
 		DateCreated:       gofakeit.Date(),
 		OofShard:          "1",
+		Status:            StatusCreated,
+	}
+
+	for _, item := range order.Items {
+		order.Payment.GoodsTotal += item.TotalPrice
 	}
+	return order
 }
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrderEqual(t *testing.T) {
+	created := time.Date(2021, 11, 26, 6, 22, 19, 0, time.UTC)
+	base := RandomOrder("b563feb7b2b84b6test")
+	base.DateCreated = created
+
+	tests := []struct {
+		name   string
+		change func(o *Order)
+		equal  bool
+	}{
+		{"identical", func(o *Order) {}, true},
+		{"same instant in another zone", func(o *Order) {
+			o.DateCreated = created.In(time.FixedZone("MSK", 3*60*60))
+		}, true},
+		{"same wall clock in another zone", func(o *Order) {
+			o.DateCreated = time.Date(2021, 11, 26, 6, 22, 19, 0, time.FixedZone("MSK", 3*60*60))
+		}, false},
+		{"nanoseconds dropped by timestamp", func(o *Order) { o.DateCreated = created.Add(999 * time.Nanosecond) }, true},
+		{"another microsecond", func(o *Order) { o.DateCreated = created.Add(time.Microsecond) }, false},
+		{"status and version", func(o *Order) { o.Status, o.Version = StatusPaid, 3 }, true},
+		{"items reordered", func(o *Order) { o.Items[0], o.Items[1] = o.Items[1], o.Items[0] }, false},
+		{"item changed", func(o *Order) { o.Items[1].Price++ }, false},
+		{"item removed", func(o *Order) { o.Items = o.Items[:1] }, false},
+		{"delivery changed", func(o *Order) { o.Delivery.City += "x" }, false},
+		{"payment changed", func(o *Order) { o.Payment.Amount++ }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := *base
+			other.Items = append([]Item(nil), base.Items...)
+			tt.change(&other)
+			if got := base.Equal(&other); got != tt.equal {
+				t.Fatalf("Equal() = %v, want %v", got, tt.equal)
+			}
+			if got := other.Equal(base); got != tt.equal {
+				t.Fatalf("Equal() isn't symmetric")
+			}
+		})
+	}
+
+	var none *Order
+	if !none.Equal(nil) || none.Equal(base) || base.Equal(nil) {
+		t.Fatal("nil orders must be equal to nil only")
+	}
+}
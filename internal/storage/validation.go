@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidOrder -- the order hasn't passed validation, the invalid fields are listed in ValidationError.
+var ErrInvalidOrder = errors.New("invalid order")
+
+// FieldError -- describes an invalid field. Field is the JSON path of the field, e.g. "items[1].track_number".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError -- is returned by Order.Validate and lists all the invalid fields of the order.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		msgs = append(msgs, field.Field+": "+field.Message)
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalidOrder, strings.Join(msgs, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidOrder
+}
+
+var phoneRegexp = regexp.MustCompile(`^\+?[0-9]{7,15}$`)
+
+// currencies -- are the active ISO 4217 currency codes.
+var currencies = map[string]struct{}{}
+
+func init() {
+	for _, code := range strings.Fields(`
+		AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL BSD BTN BWP BYN BZD CAD CDF CHF CLP
+		CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD HNL HTG HUF IDR
+		ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT
+		MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD
+		SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD UYU UZS VES VND
+		VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL`) {
+		currencies[code] = struct{}{}
+	}
+}
+
+// validator -- collects FieldError while checking the order.
+type validator struct {
+	fields []FieldError
+}
+
+func (v *validator) add(field, message string) {
+	v.fields = append(v.fields, FieldError{Field: field, Message: message})
+}
+
+// positive -- checks the value the storage constrains to be greater than zero and to fit into limit.
+func (v *validator) positive(field string, value, limit uint64) {
+	switch {
+	case value == 0:
+		v.add(field, "must be positive")
+	case value > limit:
+		v.add(field, fmt.Sprintf("must not exceed %d", limit))
+	}
+}
+
+// maxLen -- checks the value fits into the VARCHAR column of limit characters.
+func (v *validator) maxLen(field, value string, limit int) {
+	if utf8.RuneCountInString(value) > limit {
+		v.add(field, fmt.Sprintf("must not exceed %d characters", limit))
+	}
+}
+
+func (v *validator) required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "is required")
+		return false
+	}
+	return true
+}
+
+// Validate -- checks the order before it is cached or saved. Returns *ValidationError listing every invalid field.
+func (o *Order) Validate() error {
+	var v validator
+
+	v.required("order_uid", o.OrderID)
+	v.required("track_number", o.TrackNum)
+	v.required("entry", o.Entry)
+	v.required("customer_id", o.CustomerId)
+	v.required("delivery_service", o.DeliveryService)
+	// the limits are the lengths of the columns, see the migrations
+	v.maxLen("order_uid", o.OrderID, 64)
+	v.maxLen("track_number", o.TrackNum, 64)
+	v.maxLen("entry", o.Entry, 64)
+	v.maxLen("locale", o.Locale, 10)
+	v.maxLen("internal_signature", o.InternalSignature, 64)
+	v.maxLen("customer_id", o.CustomerId, 64)
+	v.maxLen("delivery_service", o.DeliveryService, 64)
+	v.maxLen("shardkey", o.Shardkey, 64)
+	v.maxLen("oof_shard", o.OofShard, 32)
+	if o.DateCreated.IsZero() {
+		v.add("date_created", "is required")
+	}
+	if o.Status != "" && o.Status != StatusCreated {
+		v.add("status", "new order must be "+string(StatusCreated))
+	}
+
+	o.Delivery.validate(&v)
+	o.Payment.validate(&v, o.OrderID)
+
+	if len(o.Items) == 0 {
+		v.add("items", "must contain at least one item")
+	}
+	var total uint64
+	for i := range o.Items {
+		o.Items[i].validate(&v, fmt.Sprintf("items[%d]", i), o.TrackNum)
+		total += uint64(o.Items[i].TotalPrice)
+	}
+	if len(o.Items) != 0 && uint64(o.Payment.GoodsTotal) != total {
+		v.add("payment.goods_total", fmt.Sprintf("must be equal to the sum of items' total_price: %d", total))
+	}
+
+	if len(v.fields) != 0 {
+		return &ValidationError{Fields: v.fields}
+	}
+	return nil
+}
+
+func (d *Delivery) validate(v *validator) {
+	v.required("delivery.name", d.Name)
+	v.required("delivery.city", d.City)
+	v.required("delivery.address", d.Address)
+	v.maxLen("delivery.name", d.Name, 64)
+	v.maxLen("delivery.zip", d.Zip, 16)
+	v.maxLen("delivery.city", d.City, 32)
+	v.maxLen("delivery.address", d.Address, 64)
+	v.maxLen("delivery.region", d.Region, 32)
+	v.maxLen("delivery.email", d.Email, 64)
+
+	if v.required("delivery.phone", d.Phone) && !phoneRegexp.MatchString(d.Phone) {
+		v.add("delivery.phone", "must contain 7 to 15 digits with an optional leading +")
+	}
+
+	if v.required("delivery.email", d.Email) {
+		if addr, err := mail.ParseAddress(d.Email); err != nil || addr.Address != d.Email {
+			v.add("delivery.email", "must be a valid email address")
+		}
+	}
+}
+
+func (p *Payment) validate(v *validator, orderID string) {
+	if v.required("payment.transaction", p.Transaction) && p.Transaction != orderID {
+		v.add("payment.transaction", "must match the order's order_uid")
+	}
+	v.required("payment.provider", p.Provider)
+	v.maxLen("payment.request_id", p.ReqID, 64)
+	v.maxLen("payment.provider", p.Provider, 32)
+	v.maxLen("payment.bank", p.Bank, 32)
+
+	v.positive("payment.payment_dt", uint64(p.PaymentDt), math.MaxUint32)
+	v.positive("payment.delivery_cost", uint64(p.DeliveryCost), math.MaxUint16)
+	v.positive("payment.goods_total", uint64(p.GoodsTotal), math.MaxUint32)
+	if p.CustomFee > math.MaxInt16 {
+		v.add("payment.custom_fee", fmt.Sprintf("must not exceed %d", math.MaxInt16))
+	}
+
+	if v.required("payment.currency", p.Currency) {
+		if _, ok := currencies[p.Currency]; !ok {
+			v.add("payment.currency", "must be an ISO 4217 currency code")
+		}
+	}
+}
+
+func (i *Item) validate(v *validator, path, trackNum string) {
+	v.required(path+".rid", i.Rid)
+	v.required(path+".name", i.Name)
+	v.maxLen(path+".rid", i.Rid, 64)
+	v.maxLen(path+".name", i.Name, 32)
+	v.maxLen(path+".size", i.Size, 16)
+	v.maxLen(path+".brand", i.Brand, 32)
+	v.positive(path+".total_price", uint64(i.TotalPrice), math.MaxInt32)
+	v.positive(path+".nm_id", uint64(i.NmID), math.MaxInt32)
+
+	if i.TrackNumber != trackNum {
+		v.add(path+".track_number", "must match the order's track_number")
+	}
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(o *Order)
+		fields []string
+	}{
+		{"valid", func(o *Order) {}, nil},
+		{"missing order_uid", func(o *Order) { o.OrderID = " " }, []string{"order_uid", "payment.transaction"}},
+		{"foreign transaction", func(o *Order) { o.Payment.Transaction = "other" }, []string{"payment.transaction"}},
+		{"zero payment_dt", func(o *Order) { o.Payment.PaymentDt = 0 }, []string{"payment.payment_dt"}},
+		{"zero delivery_cost", func(o *Order) { o.Payment.DeliveryCost = 0 }, []string{"payment.delivery_cost"}},
+		{"custom_fee overflows smallint", func(o *Order) { o.Payment.CustomFee = math.MaxInt16 + 1 }, []string{"payment.custom_fee"}},
+		{"largest custom_fee", func(o *Order) { o.Payment.CustomFee = math.MaxInt16 }, nil},
+		{"zero goods_total", func(o *Order) {
+			o.Items = o.Items[:1]
+			o.Items[0].TotalPrice, o.Payment.GoodsTotal = 0, 0
+		}, []string{"payment.goods_total", "items[0].total_price"}},
+		{"total_price overflows int", func(o *Order) {
+			o.Items = o.Items[:1]
+			o.Items[0].TotalPrice, o.Payment.GoodsTotal = math.MaxInt32+1, math.MaxInt32+1
+		}, []string{"items[0].total_price"}},
+		{"zero nm_id", func(o *Order) { o.Items[1].NmID = 0 }, []string{"items[1].nm_id"}},
+		{"nm_id overflows int", func(o *Order) { o.Items[0].NmID = math.MaxInt32 + 1 }, []string{"items[0].nm_id"}},
+		{"goods_total mismatch", func(o *Order) { o.Payment.GoodsTotal++ }, []string{"payment.goods_total"}},
+		{"foreign item track_number", func(o *Order) { o.Items[0].TrackNumber = "other" }, []string{"items[0].track_number"}},
+		{"no items", func(o *Order) { o.Items = nil }, []string{"items"}},
+		{"bad contacts", func(o *Order) { o.Delivery.Phone, o.Delivery.Email = "call me", "me" },
+			[]string{"delivery.phone", "delivery.email"}},
+		{"unknown currency", func(o *Order) { o.Payment.Currency = "ABC" }, []string{"payment.currency"}},
+		{"not a new order", func(o *Order) { o.Status = StatusPaid }, []string{"status"}},
+		{"longest locale", func(o *Order) { o.Locale = strings.Repeat("я", 10) }, nil},
+		{"locale overflows varchar", func(o *Order) { o.Locale = "Luxembourgish" }, []string{"locale"}},
+		{"oof_shard overflows varchar", func(o *Order) { o.OofShard = strings.Repeat("1", 33) }, []string{"oof_shard"}},
+		{"order_uid overflows varchar", func(o *Order) {
+			o.OrderID = strings.Repeat("a", 65)
+			o.Payment.Transaction = o.OrderID
+		}, []string{"order_uid"}},
+		{"delivery overflows varchar", func(o *Order) {
+			o.Delivery.City, o.Delivery.Zip = strings.Repeat("c", 33), strings.Repeat("1", 17)
+		}, []string{"delivery.city", "delivery.zip"}},
+		{"phone overflows varchar", func(o *Order) { o.Delivery.Phone = "+" + strings.Repeat("1", 16) }, []string{"delivery.phone"}},
+		{"payment overflows varchar", func(o *Order) { o.Payment.Bank = strings.Repeat("b", 33) }, []string{"payment.bank"}},
+		{"item overflows varchar", func(o *Order) {
+			o.Items[1].Name, o.Items[1].Brand, o.Items[1].Size = strings.Repeat("n", 33), strings.Repeat("b", 33), strings.Repeat("s", 17)
+		}, []string{"items[1].name", "items[1].brand", "items[1].size"}},
+		{"multibyte item name fits", func(o *Order) { o.Items[0].Name = strings.Repeat("ё", 32) }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := RandomOrder("b563feb7b2b84b6test")
+			tt.change(order)
+
+			err := order.Validate()
+			if tt.fields == nil {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || !errors.Is(err, ErrInvalidOrder) {
+				t.Fatalf("Validate() = %v, want *ValidationError", err)
+			}
+			got := make(map[string]bool)
+			for _, field := range validationErr.Fields {
+				got[field.Field] = true
+			}
+			for _, field := range tt.fields {
+				if !got[field] {
+					t.Errorf("%s isn't reported: %v", field, err)
+				}
+			}
+			if len(got) != len(tt.fields) {
+				t.Errorf("reported %v, want %v", validationErr.Fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestRandomOrderIsValid(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		order := RandomOrder("b563feb7b2b84b6test")
+		if err := order.Validate(); err != nil {
+			t.Fatalf("RandomOrder() is invalid: %v", err)
+		}
+	}
+}
@@ -10,7 +10,7 @@ import (
 func New() string {
 	guid, err := uuid.NewRandom()
 	if err != nil {
-		slog.Error("Error generating guid: ", err)
+		slog.Error("Error generating guid", "err", err)
 	}
 	return guid.String()
 }